@@ -0,0 +1,289 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var (
+	breakerFailures = kingpin.Flag("collector.breaker.failures",
+		"Number of consecutive lstc_qrun failures to reach a target that open its circuit breaker, 0 to disable").Default("5").Int()
+	breakerCooldown = kingpin.Flag("collector.breaker.cooldown",
+		"Duration an open circuit breaker fails fast before lstc_qrun is run again to probe the target").Default("1m").Duration()
+	breakerExpire = kingpin.Flag("collector.breaker.expire",
+		"Duration after which the circuit breaker of a target that is no longer scraped is removed, 0 to keep it").Default("1h").Duration()
+	breakerStates = []string{breakerClosed, breakerOpen, breakerHalfOpen}
+	breakerState  = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "circuit_breaker_state",
+		Help:      "Indicates the state of the circuit breaker of a target",
+	}, []string{"target", "state"})
+)
+
+// CircuitOpenError is returned without running lstc_qrun while the circuit
+// breaker of a target is open.
+type CircuitOpenError struct {
+	Target string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of target %s is open", e.Target)
+}
+
+// BreakerRunner stops running the reports of a target that failed to be
+// reached --collector.breaker.failures times in a row. The open breaker fails
+// fast for --collector.breaker.cooldown, then lets one report through half-open
+// to probe the target, which closes the breaker on success or opens it again.
+// Breakers of targets not scraped within --collector.breaker.expire are removed.
+type BreakerRunner struct {
+	runner   Runner
+	failures int
+	cooldown time.Duration
+	expire   time.Duration
+	mutex    sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	opened   time.Time
+	used     time.Time
+}
+
+// breakerReport is one report of a snapshot, the breaker records a single
+// outcome for all of its attempts when the report finishes.
+type breakerReport struct {
+	mutex   sync.Mutex
+	runner  *BreakerRunner
+	target  string
+	outcome string
+}
+
+type breakerReportKey struct{}
+
+const (
+	reportFailed    = "failed"
+	reportSucceeded = "succeeded"
+)
+
+// withBreakerReport returns ctx for the attempts of one report.
+func withBreakerReport(ctx context.Context) (context.Context, *breakerReport) {
+	report := &breakerReport{}
+	return context.WithValue(ctx, breakerReportKey{}, report), report
+}
+
+// admit returns true when an earlier attempt of the report was let through
+// by r or r allows target, so retries of a half-open probe are not rejected.
+func (b *breakerReport) admit(r *BreakerRunner, target string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.runner == r && b.target == target {
+		return true
+	}
+	if !r.allow(target) {
+		return false
+	}
+	b.runner, b.target = r, target
+	return true
+}
+
+func (b *breakerReport) set(outcome string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.outcome = outcome
+}
+
+// finish records the outcome of the last attempt, a report that was
+// cancelled without an outcome releases its probe of a half-open breaker.
+func (b *breakerReport) finish() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.runner == nil {
+		return
+	}
+	if b.outcome == "" {
+		b.runner.release(b.target)
+		return
+	}
+	b.runner.record(b.target, b.outcome == reportFailed)
+}
+
+// NewBreakerRunner returns runner with a circuit breaker per target.
+func NewBreakerRunner(runner Runner) *BreakerRunner {
+	return &BreakerRunner{
+		runner:   runner,
+		failures: *breakerFailures,
+		cooldown: *breakerCooldown,
+		expire:   *breakerExpire,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func (r *BreakerRunner) Features(ctx context.Context, target string) (string, error) {
+	return r.do(ctx, target, r.runner.Features)
+}
+
+func (r *BreakerRunner) Programs(ctx context.Context, target string) (string, error) {
+	return r.do(ctx, target, r.runner.Programs)
+}
+
+func (r *BreakerRunner) do(ctx context.Context, target string,
+	report func(ctx context.Context, target string) (string, error)) (string, error) {
+	if r.failures <= 0 {
+		return report(ctx, target)
+	}
+	snapshotReport, _ := ctx.Value(breakerReportKey{}).(*breakerReport)
+	if snapshotReport == nil {
+		if !r.allow(target) {
+			return "", &CircuitOpenError{Target: target}
+		}
+	} else if !snapshotReport.admit(r, target) {
+		return "", &CircuitOpenError{Target: target}
+	}
+	out, err := report(ctx, target)
+	// Cancellation says nothing about the target, the next report probes it
+	if errors.Is(err, context.Canceled) {
+		if snapshotReport != nil {
+			snapshotReport.set("")
+		} else {
+			r.release(target)
+		}
+		return out, err
+	}
+	failed := unreachable(out, err)
+	if snapshotReport != nil {
+		if failed {
+			snapshotReport.set(reportFailed)
+		} else {
+			snapshotReport.set(reportSucceeded)
+		}
+		return out, err
+	}
+	r.record(target, failed)
+	return out, err
+}
+
+// allow returns true when the breaker of target lets a report run. Only one
+// report probes a half-open breaker.
+func (r *BreakerRunner) allow(target string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := timeNow()
+	r.expireBreakers(now)
+	b, ok := r.breakers[target]
+	if !ok {
+		b = &breaker{state: breakerClosed}
+		r.breakers[target] = b
+		setBreakerState(target, b.state)
+	}
+	b.used = now
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if now.Sub(b.opened) >= r.cooldown {
+			b.state = breakerHalfOpen
+			setBreakerState(target, b.state)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *BreakerRunner) record(target string, failed bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	b, ok := r.breakers[target]
+	if !ok {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		b.state = breakerClosed
+	} else {
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= r.failures {
+			b.state = breakerOpen
+			b.opened = timeNow()
+		}
+	}
+	setBreakerState(target, b.state)
+}
+
+// release returns the probe of a half-open breaker without an outcome, the
+// cool-down has passed so the next report probes the target.
+func (r *BreakerRunner) release(target string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if b, ok := r.breakers[target]; ok && b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		setBreakerState(target, b.state)
+	}
+}
+
+// expireBreakers removes the breakers of targets not scraped within
+// --collector.breaker.expire and their state metrics.
+func (r *BreakerRunner) expireBreakers(now time.Time) {
+	if r.expire <= 0 {
+		return
+	}
+	for target, b := range r.breakers {
+		if now.Sub(b.used) > r.expire {
+			delete(r.breakers, target)
+			for _, s := range breakerStates {
+				breakerState.DeleteLabelValues(target, s)
+			}
+		}
+	}
+}
+
+// unreachable returns true when a report failed because the target could not
+// be reached, errors reported by a reachable license server do not count.
+func unreachable(out string, err error) bool {
+	if err == nil {
+		return strings.TrimSpace(out) == ""
+	}
+	switch errorReason(err) {
+	case reasonTimeout, reasonConnectionRefused, reasonUnknownHost:
+		return true
+	}
+	return false
+}
+
+func setBreakerState(target string, state string) {
+	for _, s := range breakerStates {
+		value := 0
+		if s == state {
+			value = 1
+		}
+		breakerState.WithLabelValues(target, s).Set(float64(value))
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreakerRunner(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--collector.breaker.failures=2", "--collector.breaker.cooldown=30s"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		timeNow = time.Now
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	calls := 0
+	var reportErr error
+	runner := NewBreakerRunner(&fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			calls++
+			if reportErr != nil {
+				return "", reportErr
+			}
+			return featureStdout, nil
+		},
+	})
+	target := "31011@breaker"
+	state := func() string {
+		return breakerTestState(target)
+	}
+	var circuitErr *CircuitOpenError
+
+	// Errors of a reachable server do not open the breaker
+	reportErr = &ExecError{ExitCode: 1, Message: "Client version R9 is not supported by server version R11"}
+	for i := 0; i < 3; i++ {
+		_, _ = runner.Features(context.Background(), target)
+	}
+	if state() != "closed" {
+		t.Errorf("Unexpected state %s after server errors", state())
+	}
+
+	reportErr = fmt.Errorf("connect: Connection refused")
+	_, _ = runner.Features(context.Background(), target)
+	_, _ = runner.Features(context.Background(), target)
+	if state() != "open" {
+		t.Errorf("Unexpected state %s after consecutive failures", state())
+	}
+	calls = 0
+	if _, err := runner.Features(context.Background(), target); !errors.As(err, &circuitErr) {
+		t.Errorf("Expected open circuit error, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Open breaker ran lstc_qrun")
+	}
+
+	// A failed probe after the cool-down opens the breaker again
+	now = now.Add(30 * time.Second)
+	_, _ = runner.Features(context.Background(), target)
+	if calls != 1 || state() != "open" {
+		t.Errorf("Unexpected calls %d and state %s after failed probe", calls, state())
+	}
+	if _, err := runner.Features(context.Background(), target); !errors.As(err, &circuitErr) {
+		t.Errorf("Expected open circuit error, got %v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	reportErr = nil
+	if !runner.allow(target) || state() != "half_open" {
+		t.Errorf("Expected half open probe, got state %s", state())
+	}
+	if runner.allow(target) {
+		t.Errorf("Half open breaker allowed a second probe")
+	}
+	runner.record(target, false)
+	if out, err := runner.Features(context.Background(), target); err != nil || out != featureStdout {
+		t.Errorf("Unexpected result after probe succeeded: %v", err)
+	}
+	if state() != "closed" {
+		t.Errorf("Unexpected state %s after successful probe", state())
+	}
+}
+
+func TestBreakerRunnerDisabled(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--collector.breaker.failures=0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	runner := NewBreakerRunner(&fakeRunner{
+		programs: func(ctx context.Context, target string) (string, error) {
+			return "", context.DeadlineExceeded
+		},
+	})
+	for i := 0; i < 10; i++ {
+		if _, err := runner.Programs(context.Background(), "31011@disabled"); err != context.DeadlineExceeded {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+}
+
+func breakerTestState(target string) string {
+	for _, s := range breakerStates {
+		if testutil.ToFloat64(breakerState.WithLabelValues(target, s)) == 1 {
+			return s
+		}
+	}
+	return ""
+}
+
+func TestBreakerRunnerRetries(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--collector.breaker.failures=2", "--collector.retry-backoff=1ms"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	runner := NewBreakerRunner(&fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			return "", fmt.Errorf("connect: Connection refused")
+		},
+	})
+	target := "31011@retries"
+	snapshot := NewSnapshot(context.Background(), target, runner, log.NewNopLogger())
+	defer snapshot.Close()
+	_, _, _, err := snapshot.features()
+	if reason := errorReason(err); reason != "connection_refused" || snapshot.feature.attempts != 3 {
+		t.Errorf("Unexpected reason %s and attempts %d", reason, snapshot.feature.attempts)
+	}
+	if state := breakerTestState(target); state != "closed" {
+		t.Errorf("Unexpected state %s, retries of a report counted as failures", state)
+	}
+	snapshot = NewSnapshot(context.Background(), target, runner, log.NewNopLogger())
+	defer snapshot.Close()
+	_, _, _, _ = snapshot.features()
+	if state := breakerTestState(target); state != "open" {
+		t.Errorf("Unexpected state %s after two failed reports", state)
+	}
+}
+
+func TestBreakerRunnerCanceled(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--collector.breaker.failures=1", "--collector.breaker.cooldown=30s"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		timeNow = time.Now
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	runner := NewBreakerRunner(&fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", fmt.Errorf("connect: Connection refused")
+		},
+	})
+	target := "31011@canceled"
+	_, _ = runner.Features(context.Background(), target)
+	if state := breakerTestState(target); state != "open" {
+		t.Fatalf("Unexpected state %s after failure", state)
+	}
+	now = now.Add(30 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// A cancelled probe neither closes nor keeps the breaker half-open
+	for _, probe := range []func(){
+		func() { _, _ = runner.Features(ctx, target) },
+		func() {
+			snapshot := NewSnapshot(ctx, target, runner, log.NewNopLogger())
+			defer snapshot.Close()
+			_, _, _, _ = snapshot.features()
+		},
+	} {
+		probe()
+		if state := breakerTestState(target); state != "open" {
+			t.Errorf("Unexpected state %s after cancelled probe", state)
+		}
+		if !runner.allow(target) {
+			t.Errorf("Expected next report to probe the target")
+		}
+		runner.release(target)
+	}
+}
+
+func TestBreakerRunnerExpire(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--collector.breaker.expire=1h"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		timeNow = time.Now
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	runner := NewBreakerRunner(&fakeRunner{})
+	for _, target := range []string{"31011@expire01", "31011@expire02"} {
+		for _, s := range breakerStates {
+			breakerState.DeleteLabelValues(target, s)
+		}
+	}
+	series := testutil.CollectAndCount(breakerState)
+	runner.allow("31011@expire01")
+	now = now.Add(30 * time.Minute)
+	runner.allow("31011@expire02")
+	now = now.Add(45 * time.Minute)
+	runner.allow("31011@expire02")
+	if _, ok := runner.breakers["31011@expire01"]; ok || len(runner.breakers) != 1 {
+		t.Errorf("Expected idle breaker to be removed, got %v", runner.breakers)
+	}
+	if count := testutil.CollectAndCount(breakerState); count != series+3 {
+		t.Errorf("Expected state metrics of idle breaker to be removed, got %d series", count-series)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	exporterCacheMaxAge = kingpin.Flag("exporter.cache-max-age",
+		"Maximum age of cached metrics that are served, 0 for no limit").Default("0s").Duration()
+	exporterCacheExpire = kingpin.Flag("exporter.cache-expire",
+		"Duration after which cached metrics of a target that is no longer scraped are removed, 0 to keep them").Default("0s").Duration()
+	featureCache = newMetricCache[featureCacheValue]("feature")
+	programCache = newMetricCache[[]ProgramMetric]("program")
+	cacheAge     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "cache_age_seconds"),
+		"Number of seconds since the cached metrics of a target were collected", []string{"collector", "target"}, nil)
+)
+
+// featureCacheValue is the cached feature report of a target.
+type featureCacheValue struct {
+	Metrics []FeatureMetric
+	Groups  []GroupMetric
+}
+
+// metricCache is the last successful report of each target, used by
+// --exporter.use-cache when collecting a report fails.
+type metricCache[T any] struct {
+	collector string
+	mutex     sync.Mutex
+	entries   map[string]*cacheEntry[T]
+	// saving serializes saving the entry of each target to --exporter.state-dir
+	saving map[string]*sync.Mutex
+}
+
+// cacheEntry is a cached report, written is when the report was collected
+// and scraped is when the target was last scraped.
+type cacheEntry[T any] struct {
+	value   T
+	written time.Time
+	scraped time.Time
+}
+
+func newMetricCache[T any](collector string) *metricCache[T] {
+	return &metricCache[T]{
+		collector: collector,
+		entries:   make(map[string]*cacheEntry[T]),
+		saving:    make(map[string]*sync.Mutex),
+	}
+}
+
+// read returns the cached report of target unless it is older than
+// --exporter.cache-max-age.
+func (c *metricCache[T]) read(target string) (T, bool) {
+	var value T
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := timeNow()
+	c.expire(now)
+	entry, ok := c.entries[target]
+	if !ok {
+		return value, false
+	}
+	entry.scraped = now
+	if *exporterCacheMaxAge > 0 && now.Sub(entry.written) > *exporterCacheMaxAge {
+		return value, false
+	}
+	return entry.value, true
+}
+
+// write caches the report of target and saves it to --exporter.state-dir when
+// set. Saving happens without holding the cache so other targets are not blocked.
+func (c *metricCache[T]) write(target string, value T) error {
+	c.mutex.Lock()
+	now := timeNow()
+	c.expire(now)
+	entry := &cacheEntry[T]{value: value, written: now, scraped: now}
+	c.entries[target] = entry
+	saving, ok := c.saving[target]
+	if !ok {
+		saving = &sync.Mutex{}
+		c.saving[target] = saving
+	}
+	c.mutex.Unlock()
+	if *exporterStateDir == "" {
+		return nil
+	}
+	saving.Lock()
+	defer saving.Unlock()
+	// A later write of the target saves its own entry
+	c.mutex.Lock()
+	current := c.entries[target] == entry
+	c.mutex.Unlock()
+	if !current {
+		return nil
+	}
+	return c.save(target, entry)
+}
+
+// expire removes the entries of targets not scraped within --exporter.cache-expire
+// and their files in --exporter.state-dir.
+func (c *metricCache[T]) expire(now time.Time) {
+	if *exporterCacheExpire <= 0 {
+		return
+	}
+	for target, entry := range c.entries {
+		if now.Sub(entry.scraped) > *exporterCacheExpire {
+			delete(c.entries, target)
+			delete(c.saving, target)
+			c.removeState(target)
+		}
+	}
+}
+
+// ages returns the age in seconds of the cached report of each target.
+func (c *metricCache[T]) ages() map[string]float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := timeNow()
+	c.expire(now)
+	ages := make(map[string]float64, len(c.entries))
+	for target, entry := range c.entries {
+		ages[target] = now.Sub(entry.written).Seconds()
+	}
+	return ages
+}
+
+func (c *metricCache[T]) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*cacheEntry[T])
+	c.saving = make(map[string]*sync.Mutex)
+}
+
+// cacheCollector exports the age of the cached reports on the exporter's /metrics.
+type cacheCollector struct{}
+
+func (c cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheAge
+}
+
+func (c cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	collectCacheAges(ch, featureCache.collector, featureCache.ages())
+	collectCacheAges(ch, programCache.collector, programCache.ages())
+}
+
+func collectCacheAges(ch chan<- prometheus.Metric, collector string, ages map[string]float64) {
+	targets := make([]string, 0, len(ages))
+	for target := range ages {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		ch <- prometheus.MustNewConstMetric(cacheAge, prometheus.GaugeValue, ages[target], collector, target)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setupCache(t *testing.T, args ...string) *time.Time {
+	if _, err := kingpin.CommandLine.Parse(append([]string{"--path.lstc_qrun=/dne"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	featureCache.reset()
+	programCache.reset()
+	t.Cleanup(func() {
+		timeNow = time.Now
+		featureCache.reset()
+		programCache.reset()
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return &now
+}
+
+func TestMetricCacheMaxAge(t *testing.T) {
+	now := setupCache(t, "--exporter.cache-max-age=10m", "--exporter.cache-expire=0")
+	programCache.write("31011@license01", []ProgramMetric{{User: "hna"}})
+	*now = now.Add(10 * time.Minute)
+	if metrics, ok := programCache.read("31011@license01"); !ok || metrics[0].User != "hna" {
+		t.Errorf("Expected cached metrics within max age")
+	}
+	*now = now.Add(time.Second)
+	if _, ok := programCache.read("31011@license01"); ok {
+		t.Errorf("Expected cached metrics older than max age not to be served")
+	}
+	if _, ok := programCache.ages()["31011@license01"]; !ok {
+		t.Errorf("Expected entry to be kept without expire")
+	}
+}
+
+func TestMetricCacheExpire(t *testing.T) {
+	now := setupCache(t, "--exporter.cache-max-age=0", "--exporter.cache-expire=1h")
+	featureCache.write("31011@license01", featureCacheValue{Metrics: []FeatureMetric{{Name: "MPPDYNA"}}})
+	featureCache.write("31011@license02", featureCacheValue{})
+	// Reading a target keeps its entry even though the entry is not rewritten
+	for i := 0; i < 3; i++ {
+		*now = now.Add(45 * time.Minute)
+		if _, ok := featureCache.read("31011@license01"); !ok {
+			t.Fatalf("Expected scraped target to stay cached")
+		}
+	}
+	ages := featureCache.ages()
+	if _, ok := ages["31011@license02"]; ok {
+		t.Errorf("Expected target that was not scraped to be removed")
+	}
+	if age := ages["31011@license01"]; age != (135 * time.Minute).Seconds() {
+		t.Errorf("Unexpected age %v", age)
+	}
+}
+
+func TestCacheCollector(t *testing.T) {
+	now := setupCache(t)
+	featureCache.write("31011@license01", featureCacheValue{})
+	*now = now.Add(30 * time.Second)
+	programCache.write("31011@license01", nil)
+	featureCache.write("31011@license02", featureCacheValue{})
+	*now = now.Add(90 * time.Second)
+	expected := `
+	# HELP lsdyna_exporter_cache_age_seconds Number of seconds since the cached metrics of a target were collected
+	# TYPE lsdyna_exporter_cache_age_seconds gauge
+	lsdyna_exporter_cache_age_seconds{collector="feature",target="31011@license01"} 120
+	lsdyna_exporter_cache_age_seconds{collector="feature",target="31011@license02"} 90
+	lsdyna_exporter_cache_age_seconds{collector="program",target="31011@license01"} 90
+	`
+	if err := testutil.CollectAndCompare(cacheCollector{}, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
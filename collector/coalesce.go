@@ -0,0 +1,137 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lstcQrunResultTTL = kingpin.Flag("lstc_qrun.result-ttl",
+		"Duration a successful lstc_qrun report is reused by later scrapes of the target, 0 to only share running reports").Default("0s").Duration()
+	lstcQrunCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "lstc_qrun_coalesced_total",
+		Help:      "Number of lstc_qrun reports shared with a running or recent invocation for the same target",
+	}, []string{"collector"})
+)
+
+// CoalescingRunner shares the reports of another runner between concurrent
+// callers for the same target, such as the scrapes of a Prometheus HA pair.
+// The first caller runs the report with its context and the others wait for
+// its result, a waiter runs the report again when the first caller's context
+// ended it while the waiter's has not. Successful results are also reused for
+// --lstc_qrun.result-ttl.
+type CoalescingRunner struct {
+	runner Runner
+	ttl    time.Duration
+	mutex  sync.Mutex
+	calls  map[coalesceKey]*coalescedCall
+}
+
+type coalesceKey struct {
+	collector string
+	target    string
+}
+
+// coalescedCall is a running or finished report, done is closed when it finishes.
+type coalescedCall struct {
+	done     chan struct{}
+	out      string
+	err      error
+	finished time.Time
+}
+
+// NewCoalescingRunner returns runner with concurrent reports for a target shared.
+func NewCoalescingRunner(runner Runner) *CoalescingRunner {
+	return &CoalescingRunner{
+		runner: runner,
+		ttl:    *lstcQrunResultTTL,
+		calls:  make(map[coalesceKey]*coalescedCall),
+	}
+}
+
+func (r *CoalescingRunner) Features(ctx context.Context, target string) (string, error) {
+	return r.do(ctx, coalesceKey{collector: "feature", target: target}, r.runner.Features)
+}
+
+func (r *CoalescingRunner) Programs(ctx context.Context, target string) (string, error) {
+	return r.do(ctx, coalesceKey{collector: "program", target: target}, r.runner.Programs)
+}
+
+func (r *CoalescingRunner) do(ctx context.Context, key coalesceKey,
+	report func(ctx context.Context, target string) (string, error)) (string, error) {
+	r.mutex.Lock()
+	if call, ok := r.calls[key]; ok && r.reusable(call) {
+		r.mutex.Unlock()
+		lstcQrunCoalesced.WithLabelValues(key.collector).Inc()
+		select {
+		case <-call.done:
+			if contextError(call.err) && ctx.Err() == nil {
+				return r.do(ctx, key, report)
+			}
+			return call.out, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	r.calls[key] = call
+	r.mutex.Unlock()
+
+	call.out, call.err = report(ctx, key.target)
+	r.mutex.Lock()
+	call.finished = timeNow()
+	// Failures are only shared with callers that were already waiting
+	if call.err != nil || r.ttl <= 0 {
+		if r.calls[key] == call {
+			delete(r.calls, key)
+		}
+	}
+	r.mutex.Unlock()
+	close(call.done)
+	r.expire()
+	return call.out, call.err
+}
+
+// contextError returns true when a report was stopped by its caller's context.
+func contextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// reusable returns true for a running call or a successful call within the TTL.
+func (r *CoalescingRunner) reusable(call *coalescedCall) bool {
+	if call.finished.IsZero() {
+		return true
+	}
+	return call.err == nil && timeNow().Sub(call.finished) < r.ttl
+}
+
+// expire forgets finished results older than the TTL.
+func (r *CoalescingRunner) expire() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, call := range r.calls {
+		if !r.reusable(call) {
+			delete(r.calls, key)
+		}
+	}
+}
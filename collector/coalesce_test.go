@@ -0,0 +1,166 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCoalescingRunnerConcurrent(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	release := make(chan struct{})
+	runner := NewCoalescingRunner(&fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return target, nil
+		},
+	})
+	coalesced := testutil.ToFloat64(lstcQrunCoalesced.WithLabelValues("feature"))
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			out, _ := runner.Features(context.Background(), "31011@haswell2")
+			results <- out
+		}()
+	}
+	for i := 0; i < 50 && testutil.ToFloat64(lstcQrunCoalesced.WithLabelValues("feature"))-coalesced < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if out := <-results; out != "31011@haswell2" {
+			t.Errorf("Unexpected out %s", out)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("Expected one report, got %d", calls)
+	}
+	if val := testutil.ToFloat64(lstcQrunCoalesced.WithLabelValues("feature")) - coalesced; val != 2 {
+		t.Errorf("Unexpected coalesced count %v", val)
+	}
+	// Without a TTL the next scrape runs the report again
+	if _, err := runner.Features(context.Background(), "31011@haswell2"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("Expected a new report, got %d", calls)
+	}
+}
+
+func TestCoalescingRunnerTTL(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--lstc_qrun.result-ttl=5s"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		timeNow = time.Now
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	calls := 0
+	fail := false
+	runner := NewCoalescingRunner(&fakeRunner{
+		programs: func(ctx context.Context, target string) (string, error) {
+			calls++
+			if fail {
+				return "", fmt.Errorf("connection refused")
+			}
+			return fmt.Sprintf("report %d", calls), nil
+		},
+	})
+	if out, _ := runner.Programs(context.Background(), "host"); out != "report 1" {
+		t.Errorf("Unexpected out %s", out)
+	}
+	now = now.Add(4 * time.Second)
+	if out, _ := runner.Programs(context.Background(), "host"); out != "report 1" {
+		t.Errorf("Expected result within TTL to be reused, got %s", out)
+	}
+	now = now.Add(2 * time.Second)
+	if out, _ := runner.Programs(context.Background(), "host"); out != "report 2" {
+		t.Errorf("Expected expired result to be run again, got %s", out)
+	}
+	now = now.Add(10 * time.Second)
+	fail = true
+	if _, err := runner.Programs(context.Background(), "host"); err == nil {
+		t.Errorf("Expected error")
+	}
+	fail = false
+	if out, _ := runner.Programs(context.Background(), "host"); out != "report 4" {
+		t.Errorf("Expected failure not to be reused, got %s", out)
+	}
+}
+
+func TestCoalescingRunnerFirstCallerCanceled(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	started := make(chan struct{}, 2)
+	runner := NewCoalescingRunner(&fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				started <- struct{}{}
+				<-ctx.Done()
+				return "", ctx.Err()
+			}
+			return target, nil
+		},
+	})
+	coalesced := testutil.ToFloat64(lstcQrunCoalesced.WithLabelValues("feature"))
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := runner.Features(ctx, "31011@haswell2")
+		firstErr <- err
+	}()
+	<-started
+	type result struct {
+		out string
+		err error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		out, err := runner.Features(context.Background(), "31011@haswell2")
+		waiter <- result{out: out, err: err}
+	}()
+	for i := 0; i < 50 && testutil.ToFloat64(lstcQrunCoalesced.WithLabelValues("feature"))-coalesced < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("Expected first caller to be cancelled, got %v", err)
+	}
+	res := <-waiter
+	if res.err != nil || res.out != "31011@haswell2" {
+		t.Errorf("Unexpected waiter result %s err=%v", res.out, res.err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("Expected the waiter to run the report again, got %d reports", calls)
+	}
+}
@@ -14,7 +14,13 @@
 package collector
 
 import (
+	"context"
+	"errors"
+	"io/fs"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,12 +28,22 @@ import (
 
 const (
 	namespace = "lsdyna"
+
+	reasonConnectionRefused = "connection_refused"
+	reasonUnknownHost       = "unknown_host"
+	reasonTimeout           = "timeout"
+	reasonExecFailed        = "exec_failed"
+	reasonParseError        = "parse_error"
+	reasonServerError       = "server_error"
+	reasonServerMismatch    = "server_mismatch"
+	reasonEmptyOutput       = "empty_output"
+	reasonCircuitOpen       = "circuit_open"
 )
 
 var (
 	lstc_qrun        = kingpin.Flag("path.lstc_qrun", "Path to lstc_qrun").Required().String()
 	exporterUseCache = kingpin.Flag("exporter.use-cache", "Use cached metrics if commands timeout or produce errors").Default("false").Bool()
-	execCommand      = exec.CommandContext
+	timeNow          = time.Now
 	collectDuration  = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "exporter", "collector_duration_seconds"),
 		"Collector time duration.",
@@ -40,10 +56,142 @@ var (
 		prometheus.BuildFQName(namespace, "exporter", "collect_timeout"),
 		"Indicates the collector timed out",
 		[]string{"collector"}, nil)
+	cacheHit = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "cache_hit"),
+		"Indicates the collector served cached metrics after an error",
+		[]string{"collector"}, nil)
+	collectAttempts = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collect_attempts"),
+		"Number of lstc_qrun attempts made during collection",
+		[]string{"collector"}, nil)
+	collectErrorReason = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collect_error_reason"),
+		"Indicates the reason of an error during collection",
+		[]string{"collector", "reason"}, nil)
+	errorReasons = []string{reasonConnectionRefused, reasonUnknownHost, reasonTimeout, reasonExecFailed,
+		reasonParseError, reasonServerError, reasonServerMismatch, reasonEmptyOutput,
+		reasonCircuitOpen}
+	connectionRefusedMessages = []string{"connection refused"}
+	unknownHostMessages       = []string{"unknown host", "host not found", "could not resolve", "unable to resolve",
+		"name or service not known"}
+	parseSkippedLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "parse_skipped_lines_total",
+		Help:      "Number of lstc_qrun output lines that could not be parsed",
+	}, []string{"collector"})
 )
 
+func init() {
+	prometheus.MustRegister(parseSkippedLines)
+	prometheus.MustRegister(lstcQrunKilled)
+	prometheus.MustRegister(lstcQrunQueueWait)
+	prometheus.MustRegister(lstcQrunRejected)
+	prometheus.MustRegister(lstcQrunCoalesced)
+	prometheus.MustRegister(breakerState)
+	prometheus.MustRegister(cacheCollector{})
+}
+
 type Collector interface {
 	// Get new metrics and expose them via prometheus registry.
 	Describe(ch chan<- *prometheus.Desc)
 	Collect(ch chan<- prometheus.Metric)
 }
+
+// parseError is an error parsing lstc_qrun output.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "unable to parse lstc_qrun output: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// errorReason classifies a collection error, an empty reason is returned for no error.
+func errorReason(err error) string {
+	var execErr *exec.Error
+	var pathErr *fs.PathError
+	var lstcQrunErr *ExecError
+	var parseErr *parseError
+	var mismatchErr *ServerMismatchError
+	var circuitErr *CircuitOpenError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// A scrape the client abandoned stopped like one that timed out
+		return reasonTimeout
+	case errors.Is(err, errEmptyOutput):
+		return reasonEmptyOutput
+	case errors.As(err, &circuitErr):
+		return reasonCircuitOpen
+	case errors.As(err, &mismatchErr):
+		return reasonServerMismatch
+	case errors.As(err, &parseErr):
+		return reasonParseError
+	case errors.As(err, &execErr), errors.As(err, &pathErr):
+		return reasonExecFailed
+	case errors.As(err, &lstcQrunErr) && (lstcQrunErr.ExitCode == 126 || lstcQrunErr.ExitCode == 127):
+		return reasonExecFailed
+	}
+	message := strings.ToLower(err.Error())
+	for _, m := range connectionRefusedMessages {
+		if strings.Contains(message, m) {
+			return reasonConnectionRefused
+		}
+	}
+	for _, m := range unknownHostMessages {
+		if strings.Contains(message, m) {
+			return reasonUnknownHost
+		}
+	}
+	return reasonServerError
+}
+
+// timeoutValue is a duration flag that also accepts a number of seconds
+// without a unit, as the timeout flags did before durations were supported.
+type timeoutValue time.Duration
+
+func (v *timeoutValue) Set(value string) error {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*v = timeoutValue(seconds * float64(time.Second))
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*v = timeoutValue(d)
+	return nil
+}
+
+func (v *timeoutValue) String() string {
+	return time.Duration(*v).String()
+}
+
+func timeoutFlag(s kingpin.Settings) *time.Duration {
+	timeout := new(time.Duration)
+	s.SetValue((*timeoutValue)(timeout))
+	return timeout
+}
+
+func boolToFloat64(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func collectErrorReasonMetrics(ch chan<- prometheus.Metric, collector string, reason string) {
+	for _, r := range errorReasons {
+		value := 0
+		if r == reason {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(collectErrorReason, prometheus.GaugeValue, float64(value), collector, r)
+	}
+}
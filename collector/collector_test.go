@@ -14,21 +14,33 @@
 package collector
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	mockedExitStatus = 0
-	mockedStdout     string
-	_, cancel        = context.WithTimeout(context.Background(), 5*time.Second)
+	updateGolden       = flag.Bool("update", false, "Update golden files in testdata")
+	mockedExitStatus   = 0
+	mockedStdout       string
+	mockedStderr       string
+	mockedSleep        time.Duration
+	mockedChildPidFile string
+	_, cancel          = context.WithTimeout(context.Background(), 5*time.Second)
 )
 
 func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
@@ -39,7 +51,10 @@ func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.
 	es := strconv.Itoa(mockedExitStatus)
 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1",
 		"STDOUT=" + mockedStdout,
-		"EXIT_STATUS=" + es}
+		"EXIT_STATUS=" + es,
+		"STDERR=" + mockedStderr,
+		"SLEEP=" + mockedSleep.String(),
+		"CHILD_PID_FILE=" + mockedChildPidFile}
 	return cmd
 }
 
@@ -48,12 +63,148 @@ func TestExecCommandHelper(t *testing.T) {
 		return
 	}
 
+	// Start a child that sleeps to test killing the process group
+	if pidFile := os.Getenv("CHILD_PID_FILE"); pidFile != "" {
+		child := exec.Command(os.Args[0], "-test.run=TestExecCommandHelper")
+		child.Env = []string{"GO_WANT_HELPER_PROCESS=1", "SLEEP=" + os.Getenv("SLEEP")}
+		if err := child.Start(); err != nil {
+			os.Exit(2)
+		}
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(child.Process.Pid)), 0644); err != nil {
+			os.Exit(2)
+		}
+	}
 	//nolint:staticcheck
 	fmt.Fprintf(os.Stdout, os.Getenv("STDOUT"))
+	//nolint:staticcheck
+	fmt.Fprintf(os.Stderr, os.Getenv("STDERR"))
+	if sleep, err := time.ParseDuration(os.Getenv("SLEEP")); err == nil {
+		time.Sleep(sleep)
+	}
 	i, _ := strconv.Atoi(os.Getenv("EXIT_STATUS"))
 	os.Exit(i)
 }
 
+type fakeRunner struct {
+	features func(ctx context.Context, target string) (string, error)
+	programs func(ctx context.Context, target string) (string, error)
+}
+
+func (r *fakeRunner) Features(ctx context.Context, target string) (string, error) {
+	return r.features(ctx, target)
+}
+
+func (r *fakeRunner) Programs(ctx context.Context, target string) (string, error) {
+	return r.programs(ctx, target)
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{err: nil, reason: ""},
+		{err: context.DeadlineExceeded, reason: "timeout"},
+		{err: context.Canceled, reason: "timeout"},
+		{err: fmt.Errorf("lstc_qrun: %w", context.Canceled), reason: "timeout"},
+		{err: errEmptyOutput, reason: "empty_output"},
+		{err: &CircuitOpenError{Target: "31011@license01"}, reason: "circuit_open"},
+		{err: &ServerMismatchError{Target: "31011@license01", Server: "31011@haswell2"}, reason: "server_mismatch"},
+		{err: &parseError{err: fmt.Errorf("unable to parse expiration")}, reason: "parse_error"},
+		{err: &exec.Error{Name: "lstc_qrun", Err: exec.ErrNotFound}, reason: "exec_failed"},
+		{err: &fs.PathError{Op: "fork/exec", Path: "/dne", Err: fs.ErrNotExist}, reason: "exec_failed"},
+		{err: &ExecError{ExitCode: 127, Stderr: "lstc_qrun: not found"}, reason: "exec_failed"},
+		{err: &ExecError{ExitCode: 1, Stderr: "connect: Connection refused"}, reason: "connection_refused"},
+		{err: &ExecError{ExitCode: 1, Message: "Unknown host license01"}, reason: "unknown_host"},
+		{err: &ExecError{ExitCode: 1, Message: "Client version R9 is not supported by server version R11"}, reason: "server_error"},
+		{err: fmt.Errorf("Error"), reason: "server_error"},
+	}
+	for _, test := range tests {
+		if reason := errorReason(test.err); reason != test.reason {
+			t.Errorf("Unexpected reason for %v, got %s expected %s", test.err, reason, test.reason)
+		}
+	}
+}
+
+func TestTimeoutValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "10", expected: 10 * time.Second},
+		{value: "1.5", expected: 1500 * time.Millisecond},
+		{value: "1500ms", expected: 1500 * time.Millisecond},
+		{value: "1m", expected: time.Minute},
+	}
+	for _, test := range tests {
+		var timeout timeoutValue
+		if err := timeout.Set(test.value); err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.value, err)
+		} else if time.Duration(timeout) != test.expected {
+			t.Errorf("Unexpected timeout for %s, got %s expected %s", test.value, time.Duration(timeout), test.expected)
+		}
+	}
+	var timeout timeoutValue
+	if err := timeout.Set("ten"); err == nil {
+		t.Errorf("Expected error for invalid timeout")
+	}
+}
+
+func TestParseCorpus(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	mockNow, _ := time.Parse("01/02/2006 15:04", "03/18/2020 10:00")
+	timeNow = func() time.Time { return mockNow }
+	files, err := filepath.Glob("testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No test corpus found")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		t.Run(name, func(t *testing.T) {
+			out, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result interface{}
+			if strings.HasPrefix(name, "features") {
+				metrics, groups, err := lstc_qrun_r_parse(string(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				result = map[string]interface{}{"features": metrics, "groups": groups}
+			} else {
+				metrics, err := lstc_qrun_p_parse(string(out), log.NewNopLogger())
+				if err != nil {
+					t.Fatal(err)
+				}
+				result = metrics
+			}
+			got, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := strings.TrimSuffix(file, ".txt") + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(golden, append(got, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bytes.TrimSpace(expected), got) {
+				t.Errorf("Unexpected parse result for %s, got:\n%s", file, got)
+			}
+		})
+	}
+}
+
 func setupGatherer(collector Collector) prometheus.Gatherer {
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(collector)
@@ -0,0 +1,127 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the per-target configuration file. Targets that are not listed
+// run the local lstc_qrun binary.
+type Config struct {
+	Targets map[string]*TargetConfig `yaml:"targets"`
+}
+
+// TargetConfig is the configuration of one target. LstcQrun, Args, Env and
+// WorkingDir apply to the local lstc_qrun or, with SSH, the remote one.
+type TargetConfig struct {
+	LstcQrun   string            `yaml:"lstc_qrun"`
+	Args       []string          `yaml:"args"`
+	Env        map[string]string `yaml:"env"`
+	WorkingDir string            `yaml:"working_dir"`
+	SSH        *SSHConfig        `yaml:"ssh"`
+}
+
+// SSHConfig runs lstc_qrun for a target on a remote host over SSH.
+type SSHConfig struct {
+	Host           string `yaml:"host"`
+	User           string `yaml:"user"`
+	KeyFile        string `yaml:"key_file"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+}
+
+// lstcQrunCommand is the lstc_qrun binary of a target and how it is run.
+type lstcQrunCommand struct {
+	path string
+	args []string
+	env  []string
+	dir  string
+}
+
+// command returns the lstc_qrun command of the target, path is used when
+// the target does not set lstc_qrun.
+func (t *TargetConfig) command(path string) lstcQrunCommand {
+	command := lstcQrunCommand{
+		path: path,
+		args: t.Args,
+		dir:  t.WorkingDir,
+	}
+	if t.LstcQrun != "" {
+		command.path = t.LstcQrun
+	}
+	names := make([]string, 0, len(t.Env))
+	for name := range t.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		command.env = append(command.env, name+"="+t.Env[name])
+	}
+	return command
+}
+
+// arguments returns the arguments of the target followed by args.
+func (c lstcQrunCommand) arguments(args ...string) []string {
+	return append(append([]string{}, c.args...), args...)
+}
+
+// LoadConfig reads the configuration file, an empty path returns an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	for target, t := range config.Targets {
+		if t == nil {
+			config.Targets[target] = &TargetConfig{}
+			continue
+		}
+		if t.SSH != nil {
+			if err := t.SSH.validate(); err != nil {
+				return nil, fmt.Errorf("invalid ssh configuration of target %s: %w", target, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// validate checks required settings and sets defaults.
+func (c *SSHConfig) validate() error {
+	switch {
+	case c.Host == "":
+		return fmt.Errorf("host is required")
+	case c.User == "":
+		return fmt.Errorf("user is required")
+	case c.KeyFile == "":
+		return fmt.Errorf("key_file is required")
+	case c.KnownHostsFile == "":
+		return fmt.Errorf("known_hosts_file is required")
+	}
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		c.Host = net.JoinHostPort(c.Host, "22")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "lsdyna_exporter.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+targets:
+  31011@license01:
+    lstc_qrun: /opt/lstc/R11/lstc_qrun
+    args: ["-R"]
+    env:
+      LSTC_LICENSE: network
+      LD_LIBRARY_PATH: /opt/lstc/R11/lib
+    working_dir: /opt/lstc/R11
+    ssh:
+      host: bastion.example.com
+      user: lsdyna
+      key_file: /etc/lsdyna_exporter/id_ed25519
+      known_hosts_file: /etc/lsdyna_exporter/known_hosts
+  31011@license02:
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	ssh := config.Targets["31011@license01"].SSH
+	if ssh.Host != "bastion.example.com:22" {
+		t.Errorf("Unexpected host %s", ssh.Host)
+	}
+	command := config.Targets["31011@license01"].command("lstc_qrun")
+	if command.path != "/opt/lstc/R11/lstc_qrun" || command.dir != "/opt/lstc/R11" {
+		t.Errorf("Unexpected command %v", command)
+	}
+	if args := strings.Join(command.arguments("-r"), " "); args != "-R -r" {
+		t.Errorf("Unexpected arguments %s", args)
+	}
+	if env := strings.Join(command.env, " "); env != "LD_LIBRARY_PATH=/opt/lstc/R11/lib LSTC_LICENSE=network" {
+		t.Errorf("Unexpected env %s", env)
+	}
+	if config.Targets["31011@license02"] == nil {
+		t.Errorf("Expected empty target configuration")
+	}
+	if command := config.Targets["31011@license02"].command("/usr/local/bin/lstc_qrun"); command.path != "/usr/local/bin/lstc_qrun" {
+		t.Errorf("Unexpected default path %s", command.path)
+	}
+}
+
+func TestLoadConfigEmpty(t *testing.T) {
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(config.Targets) != 0 {
+		t.Errorf("Unexpected targets %v", config.Targets)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{config: "targets:\n  host:\n    ssh:\n      user: lsdyna\n", err: "host is required"},
+		{config: "targets:\n  host:\n    unknown: true\n", err: "field unknown not found"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(writeConfig(t, test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
+}
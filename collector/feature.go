@@ -14,14 +14,11 @@
 package collector
 
 import (
-	"bytes"
-	"context"
 	"fmt"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -31,42 +28,88 @@ import (
 )
 
 var (
-	featureTimeout    = kingpin.Flag("collector.feature.timeout", "Timeout for collecting feature information").Default("10").Int()
-	Lstc_qrun_rExec   = lstc_qrun_r
-	timeNow           = time.Now()
-	featureCache      = map[string][]FeatureMetric{}
-	featureCacheMutex = sync.RWMutex{}
+	featureTimeout     = timeoutFlag(kingpin.Flag("collector.feature.timeout", "Timeout for collecting feature information").Default("10s"))
+	featureDateLayouts = kingpin.Flag("collector.feature.date-layout",
+		"Go time layout of license expiration dates, may be repeated").Default("01/02/2006").Strings()
+	featureTimezone = kingpin.Flag("collector.feature.timezone",
+		"Timezone of the license server used for expiration dates and program start times").Default("UTC").String()
+	featureExpireAt = kingpin.Flag("collector.feature.expire-at",
+		"Whether licenses expire at the start or end of the expiration date").Default("start").Enum("start", "end")
+	permanentExpirations = []string{"permanent", "never", "00/00/0000"}
+	// featureRe matches a feature row, the CPUS column may be blank
+	featureRe = regexp.MustCompile(`^([\w\-]+)\s+(\S+)\s+(?:(\d+)\s+)?(\d+)\s+(\d+)\s+(\d+)\s+\|\s+(\d+).*`)
+	groupRe   = regexp.MustCompile(`^\s+LICENSE GROUP\s+(\d+)\s+(\d+)\s+(\d+)\s+\|\s+(\d+).*`)
 )
 
+// FeatureMetric is the sum of all rows reported for a feature.
+// ExpirationSeconds is the nearest expiration of the feature's increments,
+// Permanent is set when none of the increments expire.
 type FeatureMetric struct {
 	Name              string
+	Permanent         bool
 	ExpirationSeconds float64
+	CPUs              string
 	Used              float64
 	Free              float64
 	Total             float64
 	Queue             float64
+	Increments        []FeatureIncrement
 }
 
+// FeatureIncrement is the licenses of a feature that share an expiration.
+// Expiration is the date reported by lstc_qrun.
+type FeatureIncrement struct {
+	Permanent         bool
+	Expiration        time.Time
+	ExpirationSeconds float64
+	Total             float64
+}
+
+type GroupMetric struct {
+	Name     string
+	Features []string
+	Used     float64
+	Free     float64
+	Total    float64
+	Queue    float64
+}
+
+// FeatureAggregateMetric is the licenses of all features expiring on a date.
 type FeatureAggregateMetric struct {
-	Licenses float64
-	Features int
+	ExpirationSeconds float64
+	Licenses          float64
+	Features          int
 }
 
 type FeatureCollector struct {
 	ExpirationSeconds          *prometheus.Desc
+	Permanent                  *prometheus.Desc
+	CPUs                       *prometheus.Desc
 	Used                       *prometheus.Desc
 	Free                       *prometheus.Desc
 	Total                      *prometheus.Desc
 	Queue                      *prometheus.Desc
 	AggregateExpirationSeconds *prometheus.Desc
-	target                     string
+	IncrementExpirationSeconds *prometheus.Desc
+	IncrementTotal             *prometheus.Desc
+	GroupUsed                  *prometheus.Desc
+	GroupFree                  *prometheus.Desc
+	GroupTotal                 *prometheus.Desc
+	GroupQueue                 *prometheus.Desc
+	GroupFeature               *prometheus.Desc
+	snapshot                   *Snapshot
 	logger                     log.Logger
 }
 
-func NewFeatureExporter(target string, logger log.Logger) Collector {
+// NewFeatureExporter returns a collector of the feature report of the snapshot's target.
+func NewFeatureExporter(snapshot *Snapshot, logger log.Logger) Collector {
 	return &FeatureCollector{
 		ExpirationSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "expiration_seconds"),
 			"Number of seconds till the LTSC licenses expire", []string{"name"}, nil),
+		Permanent: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "permanent"),
+			"Indicates the licenses do not expire", []string{"name"}, nil),
+		CPUs: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "cpus"),
+			"Number of CPUs the licenses are limited to", []string{"name"}, nil),
 		Used: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "used"),
 			"Number of used licenses", []string{"name"}, nil),
 		Free: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "free"),
@@ -76,145 +119,293 @@ func NewFeatureExporter(target string, logger log.Logger) Collector {
 		Queue: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "queue"),
 			"Number of queued licenses", []string{"name"}, nil),
 		AggregateExpirationSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "aggregate_expiration_seconds"),
-			"Aggregate number of seconds for licenses to expire", []string{"licenses", "features"}, nil),
-		target: target,
-		logger: logger,
+			"Aggregate number of seconds for licenses to expire", []string{"licenses", "features", "expires"}, nil),
+		IncrementExpirationSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "increment_expiration_seconds"),
+			"Number of seconds till a license increment expires", []string{"name", "expires"}, nil),
+		IncrementTotal: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "increment_total"),
+			"Number of total licenses in a license increment", []string{"name", "expires"}, nil),
+		GroupUsed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "used"),
+			"Number of used licenses in a license group", []string{"group"}, nil),
+		GroupFree: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "free"),
+			"Number of free licenses in a license group", []string{"group"}, nil),
+		GroupTotal: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "total"),
+			"Number of total licenses in a license group", []string{"group"}, nil),
+		GroupQueue: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "queue"),
+			"Number of queued licenses in a license group", []string{"group"}, nil),
+		GroupFeature: prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "feature_info"),
+			"Features that draw from a license group", []string{"group", "feature"}, nil),
+		snapshot: snapshot,
+		logger:   logger,
 	}
 }
 
 func (c *FeatureCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.ExpirationSeconds
+	ch <- c.Permanent
+	ch <- c.CPUs
 	ch <- c.Used
 	ch <- c.Free
 	ch <- c.Total
 	ch <- c.Queue
 	ch <- c.AggregateExpirationSeconds
+	ch <- c.IncrementExpirationSeconds
+	ch <- c.IncrementTotal
+	ch <- c.GroupUsed
+	ch <- c.GroupFree
+	ch <- c.GroupTotal
+	ch <- c.GroupQueue
+	ch <- c.GroupFeature
+	ch <- serverInfo
 }
 
 func (c *FeatureCollector) Collect(ch chan<- prometheus.Metric) {
 	level.Debug(c.logger).Log("msg", "Collecting feature metrics")
 	collectTime := time.Now()
-	timeNow = time.Now()
 	timeout := 0
 	errorMetric := 0
-	metrics, err := c.collect()
-	if err == context.DeadlineExceeded {
-		level.Error(c.logger).Log("msg", "Timeout executing lstc_qrun")
+	metrics, groups, header, hit, err := c.collect()
+	reason := errorReason(err)
+	if reason == reasonTimeout {
+		level.Error(c.logger).Log("msg", "Timeout executing lstc_qrun", "reason", reason)
 		timeout = 1
 	} else if err != nil {
-		level.Error(c.logger).Log("msg", err)
+		level.Error(c.logger).Log("msg", "Error collecting feature metrics", "reason", reason, "err", err)
 		errorMetric = 1
 	}
-	aggrMap := make(map[float64]*FeatureAggregateMetric)
+	if header.Server != "" {
+		ch <- prometheus.MustNewConstMetric(serverInfo, prometheus.GaugeValue, 1, c.snapshot.target, header.Server, header.Version)
+	}
+	aggrMap := make(map[string]*FeatureAggregateMetric)
 	for _, m := range metrics {
-		ch <- prometheus.MustNewConstMetric(c.ExpirationSeconds, prometheus.GaugeValue, m.ExpirationSeconds, m.Name)
+		if m.Permanent {
+			ch <- prometheus.MustNewConstMetric(c.Permanent, prometheus.GaugeValue, 1, m.Name)
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.Permanent, prometheus.GaugeValue, 0, m.Name)
+			ch <- prometheus.MustNewConstMetric(c.ExpirationSeconds, prometheus.GaugeValue, m.ExpirationSeconds, m.Name)
+		}
+		if cpus, err := strconv.ParseFloat(m.CPUs, 64); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.CPUs, prometheus.GaugeValue, cpus, m.Name)
+		}
 		ch <- prometheus.MustNewConstMetric(c.Used, prometheus.GaugeValue, m.Used, m.Name)
 		ch <- prometheus.MustNewConstMetric(c.Free, prometheus.GaugeValue, m.Free, m.Name)
 		ch <- prometheus.MustNewConstMetric(c.Total, prometheus.GaugeValue, m.Total, m.Name)
 		ch <- prometheus.MustNewConstMetric(c.Queue, prometheus.GaugeValue, m.Queue, m.Name)
-		if val, ok := aggrMap[m.ExpirationSeconds]; ok {
-			val.Licenses += m.Total
-			val.Features++
-		} else {
-			aggrMap[m.ExpirationSeconds] = &FeatureAggregateMetric{
-				Licenses: m.Total,
-				Features: 1,
+		for _, i := range m.Increments {
+			if i.Permanent {
+				ch <- prometheus.MustNewConstMetric(c.IncrementTotal, prometheus.GaugeValue, i.Total, m.Name, "permanent")
+				continue
+			}
+			expires := i.Expiration.Format("2006-01-02")
+			ch <- prometheus.MustNewConstMetric(c.IncrementExpirationSeconds, prometheus.GaugeValue, i.ExpirationSeconds, m.Name, expires)
+			ch <- prometheus.MustNewConstMetric(c.IncrementTotal, prometheus.GaugeValue, i.Total, m.Name, expires)
+			if val, ok := aggrMap[expires]; ok {
+				val.Licenses += i.Total
+				val.Features++
+			} else {
+				aggrMap[expires] = &FeatureAggregateMetric{
+					ExpirationSeconds: i.ExpirationSeconds,
+					Licenses:          i.Total,
+					Features:          1,
+				}
 			}
 		}
 	}
-	aggrKeys := make([]float64, 0, len(aggrMap))
-	for exp := range aggrMap {
-		aggrKeys = append(aggrKeys, exp)
+	// The expires label identifies the series, licenses of one feature renewed
+	// with the same count would otherwise repeat the licenses and features labels
+	aggrKeys := make([]string, 0, len(aggrMap))
+	for expires := range aggrMap {
+		aggrKeys = append(aggrKeys, expires)
 	}
-	sort.Float64s(aggrKeys)
-	for _, exp := range aggrKeys {
-		val := aggrMap[exp]
+	sort.Strings(aggrKeys)
+	for _, expires := range aggrKeys {
+		val := aggrMap[expires]
 		ch <- prometheus.MustNewConstMetric(c.AggregateExpirationSeconds, prometheus.GaugeValue,
-			exp, fmt.Sprintf("%d", int64(val.Licenses)), strconv.Itoa(val.Features))
+			val.ExpirationSeconds, fmt.Sprintf("%d", int64(val.Licenses)), strconv.Itoa(val.Features), expires)
+	}
+	for _, g := range groups {
+		ch <- prometheus.MustNewConstMetric(c.GroupUsed, prometheus.GaugeValue, g.Used, g.Name)
+		ch <- prometheus.MustNewConstMetric(c.GroupFree, prometheus.GaugeValue, g.Free, g.Name)
+		ch <- prometheus.MustNewConstMetric(c.GroupTotal, prometheus.GaugeValue, g.Total, g.Name)
+		ch <- prometheus.MustNewConstMetric(c.GroupQueue, prometheus.GaugeValue, g.Queue, g.Name)
+		for _, feature := range g.Features {
+			ch <- prometheus.MustNewConstMetric(c.GroupFeature, prometheus.GaugeValue, 1, g.Name, feature)
+		}
 	}
 	ch <- prometheus.MustNewConstMetric(collectError, prometheus.GaugeValue, float64(errorMetric), "feature")
 	ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, float64(timeout), "feature")
+	ch <- prometheus.MustNewConstMetric(collectAttempts, prometheus.GaugeValue, float64(c.snapshot.feature.attempts), "feature")
+	ch <- prometheus.MustNewConstMetric(cacheHit, prometheus.GaugeValue, boolToFloat64(hit), "feature")
+	collectErrorReasonMetrics(ch, "feature", reason)
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "feature")
 }
 
-func (c *FeatureCollector) collect() ([]FeatureMetric, error) {
-	var err error
-	var out string
-	var metrics []FeatureMetric
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*featureTimeout)*time.Second)
-	defer cancel()
-	out, err = Lstc_qrun_rExec(c.target, ctx)
-	if ctx.Err() == context.DeadlineExceeded {
-		if *exporterUseCache {
-			metrics = featureReadCache(c.target)
-		}
-		return metrics, ctx.Err()
-	}
-	if err != nil {
-		if *exporterUseCache {
-			metrics = featureReadCache(c.target)
-		}
-		return metrics, err
-	}
-	metrics, err = lstc_qrun_r_parse(out)
+// collect returns the feature report, or the cached report of the target when
+// the report failed and --exporter.use-cache is set.
+func (c *FeatureCollector) collect() ([]FeatureMetric, []GroupMetric, ServerHeader, bool, error) {
+	metrics, groups, header, err := c.snapshot.features()
 	if err != nil {
 		if *exporterUseCache {
-			metrics = featureReadCache(c.target)
+			if cached, ok := featureCache.read(c.snapshot.target); ok {
+				return cached.Metrics, cached.Groups, header, true, err
+			}
 		}
-		return metrics, err
+		return metrics, groups, header, false, err
 	}
 	if *exporterUseCache {
-		featureWriteCache(c.target, metrics)
+		if err := featureCache.write(c.snapshot.target, featureCacheValue{Metrics: metrics, Groups: groups}); err != nil {
+			level.Warn(c.logger).Log("msg", "Error saving cached feature metrics", "err", err)
+		}
 	}
-	return metrics, nil
+	return metrics, groups, header, false, nil
 }
 
-func lstc_qrun_r(target string, ctx context.Context) (string, error) {
-	cmd := execCommand(ctx, *lstc_qrun, "-r", "-s", target)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+// lstc_qrun_r_parse parses the feature report. The CPUS column is usually blank
+// and is left empty when absent. A LICENSE GROUP row summarizes the shared pool
+// of the features listed directly above it.
+func lstc_qrun_r_parse(out string) ([]FeatureMetric, []GroupMetric, error) {
+	var metrics []FeatureMetric
+	var groups []GroupMetric
+	var members []string
+	location, err := time.LoadLocation(*featureTimezone)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
-	return out.String(), nil
-}
-
-func lstc_qrun_r_parse(out string) ([]FeatureMetric, error) {
-	var metrics []FeatureMetric
+	now := timeNow()
 	lines := strings.Split(out, "\n")
-	re := regexp.MustCompile(`^([\w\-]+)\s+(\d{2}/\d{2}/\d{4})\s+(\d+)\s+(\d+)\s+(\d+)\s+\|\s+(\d+).*`)
 	for _, l := range lines {
-		match := re.FindStringSubmatch(l)
-		if len(match) != 7 {
+		if match := groupRe.FindStringSubmatch(l); len(match) == 5 {
+			if len(members) == 0 {
+				continue
+			}
+			var group GroupMetric
+			group.Name = strings.Join(members, "+")
+			group.Features = members
+			group.Used, _ = strconv.ParseFloat(match[1], 64)
+			group.Free, _ = strconv.ParseFloat(match[2], 64)
+			group.Total, _ = strconv.ParseFloat(match[3], 64)
+			group.Queue, _ = strconv.ParseFloat(match[4], 64)
+			groups = append(groups, group)
+			members = nil
+			continue
+		}
+		match := featureRe.FindStringSubmatch(l)
+		if len(match) != 8 {
+			if strings.TrimSpace(l) == "" {
+				members = nil
+			}
 			continue
 		}
 		var metric FeatureMetric
 		metric.Name = match[1]
-		expiration, _ := time.Parse("01/02/2006", match[2])
-		remainingTime := expiration.Sub(timeNow)
-		metric.ExpirationSeconds = remainingTime.Seconds()
-		metric.Used, _ = strconv.ParseFloat(match[3], 64)
-		metric.Free, _ = strconv.ParseFloat(match[4], 64)
-		metric.Total, _ = strconv.ParseFloat(match[5], 64)
-		metric.Queue, _ = strconv.ParseFloat(match[6], 64)
+		metric.Permanent = isPermanentExpiration(match[2])
+		var expiration time.Time
+		if !metric.Permanent {
+			expiration, err = parseExpiration(match[2], location)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to parse expiration %q of feature %s: %w", match[2], metric.Name, err)
+			}
+			metric.ExpirationSeconds = expiresAt(expiration).Sub(now).Seconds()
+		}
+		metric.CPUs = match[3]
+		metric.Used, _ = strconv.ParseFloat(match[4], 64)
+		metric.Free, _ = strconv.ParseFloat(match[5], 64)
+		metric.Total, _ = strconv.ParseFloat(match[6], 64)
+		metric.Queue, _ = strconv.ParseFloat(match[7], 64)
+		metric.Increments = []FeatureIncrement{{
+			Permanent:         metric.Permanent,
+			Expiration:        expiration,
+			ExpirationSeconds: metric.ExpirationSeconds,
+			Total:             metric.Total,
+		}}
 		metrics = append(metrics, metric)
+		if !sliceContains(members, metric.Name) {
+			members = append(members, metric.Name)
+		}
 	}
-	return metrics, nil
+	return mergeFeatures(metrics), groups, nil
 }
 
-func featureReadCache(target string) []FeatureMetric {
-	var metrics []FeatureMetric
-	featureCacheMutex.RLock()
-	if cache, ok := featureCache[target]; ok {
-		metrics = cache
+// mergeFeatures combines rows for the same feature, such as a renewal that
+// overlaps an old increment, so each feature is exported once.
+func mergeFeatures(metrics []FeatureMetric) []FeatureMetric {
+	var merged []FeatureMetric
+	index := make(map[string]int)
+	for _, m := range metrics {
+		i, ok := index[m.Name]
+		if !ok {
+			index[m.Name] = len(merged)
+			merged = append(merged, m)
+			continue
+		}
+		f := &merged[i]
+		if !m.Permanent && (f.Permanent || m.ExpirationSeconds < f.ExpirationSeconds) {
+			f.Permanent = false
+			f.ExpirationSeconds = m.ExpirationSeconds
+		}
+		if f.CPUs == "" {
+			f.CPUs = m.CPUs
+		}
+		f.Used += m.Used
+		f.Free += m.Free
+		f.Total += m.Total
+		f.Queue += m.Queue
+		for _, increment := range m.Increments {
+			f.Increments = mergeIncrement(f.Increments, increment)
+		}
+	}
+	return merged
+}
+
+func mergeIncrement(increments []FeatureIncrement, increment FeatureIncrement) []FeatureIncrement {
+	for i := range increments {
+		if increments[i].Permanent == increment.Permanent && increments[i].Expiration.Equal(increment.Expiration) {
+			increments[i].Total += increment.Total
+			return increments
+		}
 	}
-	featureCacheMutex.RUnlock()
-	return metrics
+	return append(increments, increment)
 }
 
-func featureWriteCache(target string, metrics []FeatureMetric) {
-	featureCacheMutex.Lock()
-	featureCache[target] = metrics
-	featureCacheMutex.Unlock()
+func isPermanentExpiration(value string) bool {
+	for _, p := range permanentExpirations {
+		if strings.EqualFold(value, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpiration parses an expiration date using the configured layouts.
+// The date is in the license server's timezone.
+func parseExpiration(value string, location *time.Location) (time.Time, error) {
+	var expiration time.Time
+	err := fmt.Errorf("no date layouts configured")
+	for _, layout := range *featureDateLayouts {
+		expiration, err = time.ParseInLocation(layout, value, location)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expiration, nil
+}
+
+// expiresAt is when licenses of an expiration date expire, by default at the
+// start of the date.
+func expiresAt(expiration time.Time) time.Time {
+	if *featureExpireAt == "end" {
+		return expiration.AddDate(0, 0, 1)
+	}
+	return expiration
+}
+
+func sliceContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
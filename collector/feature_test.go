@@ -16,13 +16,13 @@ package collector
 import (
 	"context"
 	"fmt"
-	"os/exec"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -42,9 +42,12 @@ MPPDYNA          07/31/2020          0   2000   2000 |     0
 )
 
 func TestFeatureParse(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
 	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
-	timeNow = mockNow
-	metrics, err := lstc_qrun_r_parse(featureStdout)
+	timeNow = func() time.Time { return mockNow }
+	metrics, groups, err := lstc_qrun_r_parse(featureStdout)
 	if err != nil {
 		t.Errorf("Unexpected err: %s", err.Error())
 		return
@@ -59,6 +62,9 @@ func TestFeatureParse(t *testing.T) {
 	if val := metrics[0].ExpirationSeconds; val != 2592000 {
 		t.Errorf("Unexpected expiration seconds %v", val)
 	}
+	if val := metrics[0].CPUs; val != "" {
+		t.Errorf("Unexpected cpus %v", val)
+	}
 	if val := metrics[0].Used; val != 0 {
 		t.Errorf("Unexpected used %v", val)
 	}
@@ -71,15 +77,359 @@ func TestFeatureParse(t *testing.T) {
 	if val := metrics[0].Queue; val != 0 {
 		t.Errorf("Unexpected queue %v", val)
 	}
+	if len(groups) != 1 {
+		t.Errorf("Expected 1 group, got %d", len(groups))
+		return
+	}
+	if val := groups[0].Name; val != "LS-DYNA+MPPDYNA" {
+		t.Errorf("Unexpected group name %s", val)
+	}
+	if val := strings.Join(groups[0].Features, ","); val != "LS-DYNA,MPPDYNA" {
+		t.Errorf("Unexpected group features %s", val)
+	}
+	if val := groups[0].Free; val != 2000 {
+		t.Errorf("Unexpected group free %v", val)
+	}
+	if val := groups[0].Total; val != 2000 {
+		t.Errorf("Unexpected group total %v", val)
+	}
+}
+
+func TestFeatureParseGroups(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	out := `
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          07/31/2020          0    500    500 |     0
+LS-OPT           07/31/2020          4     16     20 |     0
+                   LICENSE GROUP     4     16     20 |     0
+MPPDYNA          07/31/2020        120    380    500 |     2
+MPPDYNA_971      07/31/2020        120    380    500 |     2
+                   LICENSE GROUP   120    380    500 |     2
+
+`
+	metrics, groups, err := lstc_qrun_r_parse(out)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if len(metrics) != 4 {
+		t.Errorf("Expected 4 metrics, got %d", len(metrics))
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(groups))
+	}
+	if val := groups[0].Name; val != "LS-DYNA+LS-OPT" {
+		t.Errorf("Unexpected group name %s", val)
+	}
+	if val := groups[1].Name; val != "MPPDYNA+MPPDYNA_971" {
+		t.Errorf("Unexpected group name %s", val)
+	}
+	if val := groups[1].Used; val != 120 {
+		t.Errorf("Unexpected group used %v", val)
+	}
+	if val := groups[1].Queue; val != 2 {
+		t.Errorf("Unexpected group queue %v", val)
+	}
+}
+
+func TestFeatureCPUs(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	out := `
+Using user specified server 31011@haswell2
+
+LICENSE INFORMATION
+
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          07/31/2020     64     8     24     32 |     0
+MPPDYNA          07/31/2020          0   2000   2000 |     0
+
+`
+	metrics, _, err := lstc_qrun_r_parse(out)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(metrics))
+	}
+	if val := metrics[0].CPUs; val != "64" {
+		t.Errorf("Unexpected cpus %v", val)
+	}
+	if val := metrics[0].Used; val != 8 {
+		t.Errorf("Unexpected used %v", val)
+	}
+	if val := metrics[0].Total; val != 32 {
+		t.Errorf("Unexpected total %v", val)
+	}
+	if val := metrics[1].CPUs; val != "" {
+		t.Errorf("Unexpected cpus %v", val)
+	}
+	if val := metrics[1].Used; val != 0 {
+		t.Errorf("Unexpected used %v", val)
+	}
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return out, nil
+	}
+	expected := `
+	# HELP lsdyna_feature_cpus Number of CPUs the licenses are limited to
+	# TYPE lsdyna_feature_cpus gauge
+	lsdyna_feature_cpus{name="LS-DYNA"} 64
+	`
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "lsdyna_feature_cpus"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestFeatureDuplicates(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
+	timeNow = func() time.Time { return mockNow }
+	out := `
+Using user specified server 31011@haswell2
+
+LICENSE INFORMATION
+
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          07/31/2020         10    490    500 |     0
+LS-DYNA          12/31/2020          5   1495   1500 |     1
+LS-DYNA          12/31/2020          0    100    100 |     0
+MPPDYNA          07/31/2020          0   2000   2000 |     0
+                   LICENSE GROUP    15   4085   4100 |     1
+
+`
+	metrics, groups, err := lstc_qrun_r_parse(out)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(metrics))
+	}
+	if val := metrics[0].ExpirationSeconds; val != 2592000 {
+		t.Errorf("Unexpected expiration seconds %v", val)
+	}
+	if val := metrics[0].Used; val != 15 {
+		t.Errorf("Unexpected used %v", val)
+	}
+	if val := metrics[0].Free; val != 2085 {
+		t.Errorf("Unexpected free %v", val)
+	}
+	if val := metrics[0].Total; val != 2100 {
+		t.Errorf("Unexpected total %v", val)
+	}
+	if val := metrics[0].Queue; val != 1 {
+		t.Errorf("Unexpected queue %v", val)
+	}
+	if len(metrics[0].Increments) != 2 {
+		t.Fatalf("Expected 2 increments, got %d", len(metrics[0].Increments))
+	}
+	if val := metrics[0].Increments[1].Total; val != 1600 {
+		t.Errorf("Unexpected increment total %v", val)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group, got %d", len(groups))
+	}
+	if val := groups[0].Name; val != "LS-DYNA+MPPDYNA" {
+		t.Errorf("Unexpected group name %s", val)
+	}
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return out, nil
+	}
+	expected := `
+	# HELP lsdyna_exporter_collect_error Indicates if error has occurred during collection
+	# TYPE lsdyna_exporter_collect_error gauge
+	lsdyna_exporter_collect_error{collector="feature"} 0
+	# HELP lsdyna_feature_expiration_seconds Number of seconds till the LTSC licenses expire
+	# TYPE lsdyna_feature_expiration_seconds gauge
+	lsdyna_feature_expiration_seconds{name="LS-DYNA"} 2592000
+	lsdyna_feature_expiration_seconds{name="MPPDYNA"} 2592000
+	# HELP lsdyna_feature_increment_expiration_seconds Number of seconds till a license increment expires
+	# TYPE lsdyna_feature_increment_expiration_seconds gauge
+	lsdyna_feature_increment_expiration_seconds{expires="2020-07-31",name="LS-DYNA"} 2592000
+	lsdyna_feature_increment_expiration_seconds{expires="2020-12-31",name="LS-DYNA"} 15811200
+	lsdyna_feature_increment_expiration_seconds{expires="2020-07-31",name="MPPDYNA"} 2592000
+	# HELP lsdyna_feature_increment_total Number of total licenses in a license increment
+	# TYPE lsdyna_feature_increment_total gauge
+	lsdyna_feature_increment_total{expires="2020-07-31",name="LS-DYNA"} 500
+	lsdyna_feature_increment_total{expires="2020-12-31",name="LS-DYNA"} 1600
+	lsdyna_feature_increment_total{expires="2020-07-31",name="MPPDYNA"} 2000
+	# HELP lsdyna_feature_total Number of total licenses
+	# TYPE lsdyna_feature_total gauge
+	lsdyna_feature_total{name="LS-DYNA"} 2100
+	lsdyna_feature_total{name="MPPDYNA"} 2000
+	`
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"lsdyna_feature_expiration_seconds", "lsdyna_feature_increment_expiration_seconds",
+		"lsdyna_feature_increment_total", "lsdyna_feature_total", "lsdyna_exporter_collect_error"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestFeatureExpirations(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	layouts := []string{"01/02/2006", "2006-01-02"}
+	timezone := "America/New_York"
+	expireAt := "end"
+	featureDateLayouts = &layouts
+	featureTimezone = &timezone
+	featureExpireAt = &expireAt
+	defer func() {
+		layouts = []string{"01/02/2006"}
+		timezone = "UTC"
+		expireAt = "start"
+	}()
+	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
+	timeNow = func() time.Time { return mockNow }
+	out := `
+Using user specified server 31011@haswell2
+
+LICENSE INFORMATION
+
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          07/31/2020          0    500    500 |     0
+LS-DYNA          PERMANENT           0    100    100 |     0
+LS-OPT           2020-07-31          0     10     10 |     0
+MPPDYNA          Permanent           0   2000   2000 |     0
+
+`
+	metrics, _, err := lstc_qrun_r_parse(out)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("Expected 3 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Permanent {
+		t.Errorf("Expected LS-DYNA to expire")
+	}
+	// 30 days plus the end of the day plus the UTC offset of America/New_York
+	if val := metrics[0].ExpirationSeconds; val != 2592000+86400+14400 {
+		t.Errorf("Unexpected expiration seconds %v", val)
+	}
+	if val := metrics[1].ExpirationSeconds; val != 2592000+86400+14400 {
+		t.Errorf("Unexpected expiration seconds %v", val)
+	}
+	if !metrics[2].Permanent {
+		t.Errorf("Expected MPPDYNA to be permanent")
+	}
+	// The increment keeps the reported date
+	if val := metrics[0].Increments[0].Expiration.Format("2006-01-02"); val != "2020-07-31" {
+		t.Errorf("Unexpected increment expiration %s", val)
+	}
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return out, nil
+	}
+	expected := `
+	# HELP lsdyna_feature_expiration_seconds Number of seconds till the LTSC licenses expire
+	# TYPE lsdyna_feature_expiration_seconds gauge
+	lsdyna_feature_expiration_seconds{name="LS-DYNA"} 2692800
+	lsdyna_feature_expiration_seconds{name="LS-OPT"} 2692800
+	# HELP lsdyna_feature_increment_expiration_seconds Number of seconds till a license increment expires
+	# TYPE lsdyna_feature_increment_expiration_seconds gauge
+	lsdyna_feature_increment_expiration_seconds{expires="2020-07-31",name="LS-DYNA"} 2692800
+	lsdyna_feature_increment_expiration_seconds{expires="2020-07-31",name="LS-OPT"} 2692800
+	# HELP lsdyna_feature_increment_total Number of total licenses in a license increment
+	# TYPE lsdyna_feature_increment_total gauge
+	lsdyna_feature_increment_total{expires="2020-07-31",name="LS-DYNA"} 500
+	lsdyna_feature_increment_total{expires="permanent",name="LS-DYNA"} 100
+	lsdyna_feature_increment_total{expires="2020-07-31",name="LS-OPT"} 10
+	lsdyna_feature_increment_total{expires="permanent",name="MPPDYNA"} 2000
+	# HELP lsdyna_feature_permanent Indicates the licenses do not expire
+	# TYPE lsdyna_feature_permanent gauge
+	lsdyna_feature_permanent{name="LS-DYNA"} 0
+	lsdyna_feature_permanent{name="LS-OPT"} 0
+	lsdyna_feature_permanent{name="MPPDYNA"} 1
+	`
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"lsdyna_feature_expiration_seconds", "lsdyna_feature_increment_expiration_seconds", "lsdyna_feature_increment_total",
+		"lsdyna_feature_permanent"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestFeatureRenewal(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
+	timeNow = func() time.Time { return mockNow }
+	// A renewal with the same number of licenses as the expiring increment
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return `
+Using user specified server 31011@haswell2
+
+LICENSE INFORMATION
+
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          07/31/2020          0    500    500 |     0
+LS-DYNA          12/31/2020          0    500    500 |     0
+MPPDYNA          12/31/2020          0    500    500 |     0
+
+`, nil
+	}
+	expected := `
+	# HELP lsdyna_feature_aggregate_expiration_seconds Aggregate number of seconds for licenses to expire
+	# TYPE lsdyna_feature_aggregate_expiration_seconds gauge
+	lsdyna_feature_aggregate_expiration_seconds{expires="2020-07-31",features="1",licenses="500"} 2592000
+	lsdyna_feature_aggregate_expiration_seconds{expires="2020-12-31",features="2",licenses="1000"} 15811200
+	# HELP lsdyna_feature_increment_total Number of total licenses in a license increment
+	# TYPE lsdyna_feature_increment_total gauge
+	lsdyna_feature_increment_total{expires="2020-07-31",name="LS-DYNA"} 500
+	lsdyna_feature_increment_total{expires="2020-12-31",name="LS-DYNA"} 500
+	lsdyna_feature_increment_total{expires="2020-12-31",name="MPPDYNA"} 500
+	`
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"lsdyna_feature_aggregate_expiration_seconds", "lsdyna_feature_increment_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestFeatureParseInvalidExpiration(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	out := `
+PROGRAM          EXPIRATION CPUS  USED   FREE    MAX | QUEUE
+---------------- ----------      ----- ------ ------ | -----
+LS-DYNA          31.07.2020          0    500    500 |     0
+
+`
+	_, _, err := lstc_qrun_r_parse(out)
+	if err == nil {
+		t.Errorf("Expected error parsing invalid expiration")
+	}
 }
 
 func TestFeatureCollector(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
 	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
-	timeNow = mockNow
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	timeNow = func() time.Time { return mockNow }
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return featureStdout, nil
 	}
 	expected := `
@@ -105,28 +455,46 @@ func TestFeatureCollector(t *testing.T) {
 	# TYPE lsdyna_feature_used gauge
 	lsdyna_feature_used{name="LS-DYNA"} 0
 	lsdyna_feature_used{name="MPPDYNA"} 0
+	# HELP lsdyna_group_feature_info Features that draw from a license group
+	# TYPE lsdyna_group_feature_info gauge
+	lsdyna_group_feature_info{feature="LS-DYNA",group="LS-DYNA+MPPDYNA"} 1
+	lsdyna_group_feature_info{feature="MPPDYNA",group="LS-DYNA+MPPDYNA"} 1
+	# HELP lsdyna_group_free Number of free licenses in a license group
+	# TYPE lsdyna_group_free gauge
+	lsdyna_group_free{group="LS-DYNA+MPPDYNA"} 2000
+	# HELP lsdyna_group_queue Number of queued licenses in a license group
+	# TYPE lsdyna_group_queue gauge
+	lsdyna_group_queue{group="LS-DYNA+MPPDYNA"} 0
+	# HELP lsdyna_group_total Number of total licenses in a license group
+	# TYPE lsdyna_group_total gauge
+	lsdyna_group_total{group="LS-DYNA+MPPDYNA"} 2000
+	# HELP lsdyna_group_used Number of used licenses in a license group
+	# TYPE lsdyna_group_used gauge
+	lsdyna_group_used{group="LS-DYNA+MPPDYNA"} 0
 	`
-	collector := NewFeatureExporter("localhost", log.NewNopLogger())
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 14 {
-		t.Errorf("Unexpected collection count %d, expected 14", val)
+	} else if val != 38 {
+		t.Errorf("Unexpected collection count %d, expected 38", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"lsdyna_feature_free", "lsdyna_feature_queue", "lsdyna_feature_total", "lsdyna_feature_used",
+		"lsdyna_group_feature_info", "lsdyna_group_free", "lsdyna_group_queue", "lsdyna_group_total", "lsdyna_group_used",
 		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
 
 func TestFeatureCollectorError(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
 	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
-	timeNow = mockNow
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	timeNow = func() time.Time { return mockNow }
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return "", fmt.Errorf("Error")
 	}
 	expected := `
@@ -136,28 +504,41 @@ func TestFeatureCollectorError(t *testing.T) {
     # HELP lsdyna_exporter_collect_timeout Indicates the collector timed out
     # TYPE lsdyna_exporter_collect_timeout gauge
     lsdyna_exporter_collect_timeout{collector="feature"} 0
+    # HELP lsdyna_exporter_collect_error_reason Indicates the reason of an error during collection
+    # TYPE lsdyna_exporter_collect_error_reason gauge
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="circuit_open"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="connection_refused"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="empty_output"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="exec_failed"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="parse_error"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="server_error"} 1
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="server_mismatch"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="timeout"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="unknown_host"} 0
 	`
-	collector := NewFeatureExporter("localhost", log.NewNopLogger())
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 14 {
+		t.Errorf("Unexpected collection count %d, expected 14", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"lsdyna_feature_free", "lsdyna_feature_queue", "lsdyna_feature_total", "lsdyna_feature_used",
-		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
+		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout",
+		"lsdyna_exporter_collect_error_reason"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
 
 func TestFeatureCollectorTimeout(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
 	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
-	timeNow = mockNow
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	timeNow = func() time.Time { return mockNow }
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return "", context.DeadlineExceeded
 	}
 	expected := `
@@ -167,30 +548,46 @@ func TestFeatureCollectorTimeout(t *testing.T) {
     # HELP lsdyna_exporter_collect_timeout Indicates the collector timed out
     # TYPE lsdyna_exporter_collect_timeout gauge
     lsdyna_exporter_collect_timeout{collector="feature"} 1
+    # HELP lsdyna_exporter_collect_error_reason Indicates the reason of an error during collection
+    # TYPE lsdyna_exporter_collect_error_reason gauge
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="circuit_open"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="connection_refused"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="empty_output"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="exec_failed"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="parse_error"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="server_error"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="server_mismatch"} 0
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="timeout"} 1
+    lsdyna_exporter_collect_error_reason{collector="feature",reason="unknown_host"} 0
 	`
-	collector := NewFeatureExporter("localhost", log.NewNopLogger())
+	collector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 14 {
+		t.Errorf("Unexpected collection count %d, expected 14", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"lsdyna_feature_free", "lsdyna_feature_queue", "lsdyna_feature_total", "lsdyna_feature_used",
-		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
+		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout",
+		"lsdyna_exporter_collect_error_reason"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
 
 func TestFeatureCollectorCache(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
 	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
-	timeNow = mockNow
+	timeNow = func() time.Time { return mockNow }
 	useCache := true
 	exporterUseCache = &useCache
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	defer func() {
+		useCache = false
+	}()
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return featureStdout, nil
 	}
 	expected := `
@@ -212,6 +609,9 @@ func TestFeatureCollectorCache(t *testing.T) {
 	lsdyna_feature_used{name="MPPDYNA"} 0
 	`
 	errorMetric := `
+    # HELP lsdyna_exporter_cache_hit Indicates the collector served cached metrics after an error
+    # TYPE lsdyna_exporter_cache_hit gauge
+    lsdyna_exporter_cache_hit{collector="feature"} 1
     # HELP lsdyna_exporter_collect_error Indicates if error has occurred during collection
     # TYPE lsdyna_exporter_collect_error gauge
     lsdyna_exporter_collect_error{collector="feature"} 1
@@ -221,53 +621,39 @@ func TestFeatureCollectorCache(t *testing.T) {
     # TYPE lsdyna_exporter_collect_timeout gauge
     lsdyna_exporter_collect_timeout{collector="feature"} 1
 	`
-	collector := NewFeatureExporter("localhost", log.NewNopLogger())
-	gatherers := setupGatherer(collector)
-	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+	// Each scrape collects a new snapshot
+	gatherer := func() prometheus.Gatherer {
+		return setupGatherer(NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger()))
+	}
+	if val, err := testutil.GatherAndCount(gatherer()); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 14 {
-		t.Errorf("Unexpected collection count %d, expected 14", val)
+	} else if val != 38 {
+		t.Errorf("Unexpected collection count %d, expected 38", val)
 	}
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return "", fmt.Errorf("Error")
 	}
-	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+	if val, err := testutil.GatherAndCount(gatherer()); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 14 {
-		t.Errorf("Unexpected collection count %d, expected 14", val)
+	} else if val != 37 {
+		t.Errorf("Unexpected collection count %d, expected 37", val)
 	}
-	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(errorMetric+expected),
+	if err := testutil.GatherAndCompare(gatherer(), strings.NewReader(errorMetric+expected),
 		"lsdyna_feature_free", "lsdyna_feature_queue", "lsdyna_feature_total", "lsdyna_feature_used",
-		"lsdyna_exporter_collect_error"); err != nil {
+		"lsdyna_exporter_cache_hit", "lsdyna_exporter_collect_error"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
-	Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
+	runner.features = func(ctx context.Context, target string) (string, error) {
 		return "", context.DeadlineExceeded
 	}
-	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+	if val, err := testutil.GatherAndCount(gatherer()); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 14 {
-		t.Errorf("Unexpected collection count %d, expected 14", val)
+	} else if val != 37 {
+		t.Errorf("Unexpected collection count %d, expected 37", val)
 	}
-	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(timeoutMetric+expected),
+	if err := testutil.GatherAndCompare(gatherer(), strings.NewReader(timeoutMetric+expected),
 		"lsdyna_feature_free", "lsdyna_feature_queue", "lsdyna_feature_total", "lsdyna_feature_used",
 		"lsdyna_exporter_collect_timeout"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
-
-func Test_lstc_qrun_r(t *testing.T) {
-	execCommand = fakeExecCommand
-	mockedExitStatus = 0
-	mockedStdout = "foo"
-	defer func() { execCommand = exec.CommandContext }()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	out, err := lstc_qrun_r("host", ctx)
-	if err != nil {
-		t.Errorf("Unexpected error: %s", err.Error())
-	}
-	if out != mockedStdout {
-		t.Errorf("Unexpected out: %s", out)
-	}
-}
@@ -0,0 +1,162 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lstcQrunMaxConcurrent = kingpin.Flag("lstc_qrun.max-concurrent",
+		"Maximum number of lstc_qrun invocations running at once, 0 for no limit").Default("10").Int()
+	lstcQrunMaxConcurrentPerTarget = kingpin.Flag("lstc_qrun.max-concurrent-per-target",
+		"Maximum number of lstc_qrun invocations running at once for a target, 0 for no limit").Default("2").Int()
+	lstcQrunQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "lstc_qrun_queue_wait_seconds",
+		Help:      "Time lstc_qrun invocations waited for the concurrency limits",
+		Buckets:   []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"collector"})
+	lstcQrunRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "lstc_qrun_rejected_total",
+		Help:      "Number of lstc_qrun invocations not run because the collector timed out waiting for the concurrency limits",
+	}, []string{"collector"})
+)
+
+// LimitedRunner limits the number of reports of another runner that run at
+// once, in total and per target. Reports wait for a free slot until their
+// context is done.
+type LimitedRunner struct {
+	runner    Runner
+	global    chan struct{}
+	perTarget int
+	mutex     sync.Mutex
+	targets   map[string]*targetSlots
+}
+
+// targetSlots are the slots of a target, kept while any report of the target
+// holds or waits for one.
+type targetSlots struct {
+	slots chan struct{}
+	users int
+}
+
+// NewLimitedRunner returns runner limited by --lstc_qrun.max-concurrent and
+// --lstc_qrun.max-concurrent-per-target.
+func NewLimitedRunner(runner Runner) *LimitedRunner {
+	r := &LimitedRunner{
+		runner:    runner,
+		perTarget: *lstcQrunMaxConcurrentPerTarget,
+		targets:   make(map[string]*targetSlots),
+	}
+	if *lstcQrunMaxConcurrent > 0 {
+		r.global = make(chan struct{}, *lstcQrunMaxConcurrent)
+	}
+	return r
+}
+
+func (r *LimitedRunner) Features(ctx context.Context, target string) (string, error) {
+	release, err := r.acquire(ctx, "feature", target)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return r.runner.Features(ctx, target)
+}
+
+func (r *LimitedRunner) Programs(ctx context.Context, target string) (string, error) {
+	release, err := r.acquire(ctx, "program", target)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return r.runner.Programs(ctx, target)
+}
+
+// acquire waits for a slot of the target and then a global slot, so reports
+// queued behind a busy target do not hold global slots.
+func (r *LimitedRunner) acquire(ctx context.Context, collector string, target string) (func(), error) {
+	start := time.Now()
+	slots := r.targetSlots(target)
+	releaseTarget := func() {
+		r.releaseTargetSlots(target)
+	}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			releaseTarget = func() {
+				<-slots
+				r.releaseTargetSlots(target)
+			}
+		case <-ctx.Done():
+			releaseTarget()
+			lstcQrunRejected.WithLabelValues(collector).Inc()
+			return nil, ctx.Err()
+		}
+	}
+	release := releaseTarget
+	if r.global != nil {
+		select {
+		case r.global <- struct{}{}:
+			release = func() {
+				<-r.global
+				releaseTarget()
+			}
+		case <-ctx.Done():
+			releaseTarget()
+			lstcQrunRejected.WithLabelValues(collector).Inc()
+			return nil, ctx.Err()
+		}
+	}
+	lstcQrunQueueWait.WithLabelValues(collector).Observe(time.Since(start).Seconds())
+	return release, nil
+}
+
+// targetSlots returns the slots of target, nil when targets are not limited.
+func (r *LimitedRunner) targetSlots(target string) chan struct{} {
+	if r.perTarget <= 0 {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.targets[target]
+	if !ok {
+		t = &targetSlots{slots: make(chan struct{}, r.perTarget)}
+		r.targets[target] = t
+	}
+	t.users++
+	return t.slots
+}
+
+// releaseTargetSlots forgets the slots of target once nothing uses them.
+func (r *LimitedRunner) releaseTargetSlots(target string) {
+	if r.perTarget <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t := r.targets[target]
+	t.users--
+	if t.users == 0 {
+		delete(r.targets, target)
+	}
+}
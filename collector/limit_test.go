@@ -0,0 +1,111 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingRunner returns a runner whose reports signal started and wait for release.
+func blockingRunner(started chan<- string, release <-chan struct{}) *fakeRunner {
+	report := func(ctx context.Context, target string) (string, error) {
+		started <- target
+		<-release
+		return target, nil
+	}
+	return &fakeRunner{features: report, programs: report}
+}
+
+func setupLimits(t *testing.T, global string, perTarget string) {
+	args := []string{"--path.lstc_qrun=/dne", "--lstc_qrun.max-concurrent=" + global,
+		"--lstc_qrun.max-concurrent-per-target=" + perTarget}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLimitedRunnerPerTarget(t *testing.T) {
+	setupLimits(t, "0", "1")
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	runner := NewLimitedRunner(blockingRunner(started, release))
+	rejected := testutil.ToFloat64(lstcQrunRejected.WithLabelValues("program"))
+	go func() {
+		_, _ = runner.Features(context.Background(), "31011@license01")
+	}()
+	<-started
+	// Another target is not limited by the busy target
+	go func() {
+		_, _ = runner.Features(context.Background(), "31011@license02")
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Report of another target did not start")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := runner.Programs(ctx, "31011@license01"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if val := testutil.ToFloat64(lstcQrunRejected.WithLabelValues("program")) - rejected; val != 1 {
+		t.Errorf("Unexpected rejected count %v", val)
+	}
+	close(release)
+}
+
+func TestLimitedRunnerGlobal(t *testing.T) {
+	setupLimits(t, "1", "2")
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	runner := NewLimitedRunner(blockingRunner(started, release))
+	done := make(chan string, 2)
+	go func() {
+		out, _ := runner.Features(context.Background(), "31011@license01")
+		done <- out
+	}()
+	<-started
+	go func() {
+		out, _ := runner.Features(context.Background(), "31011@license02")
+		done <- out
+	}()
+	select {
+	case <-started:
+		t.Fatal("Report started beyond the global limit")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued report did not start")
+	}
+	<-done
+	<-done
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	if len(runner.targets) != 0 {
+		t.Errorf("Target slots were not released: %v", runner.targets)
+	}
+}
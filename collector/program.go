@@ -14,9 +14,7 @@
 package collector
 
 import (
-	"bytes"
-	"context"
-	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -29,33 +27,63 @@ import (
 )
 
 var (
-	programTimeout  = kingpin.Flag("collector.programs.timeout", "Timeout for collecting programs information").Default("10").Int()
-	Lstc_qrun_pExec = lstc_qrun_p
+	programTimeout  = timeoutFlag(kingpin.Flag("collector.programs.timeout", "Timeout for collecting programs information").Default("10s"))
+	programHostUsed = kingpin.Flag("collector.programs.host-used", "Collect number of licenses used per host").Default("false").Bool()
+	// programColumnRe matches the titles of a programs table header
+	programColumnRe = regexp.MustCompile(`\S+( \S+)*`)
+	programFieldRe  = regexp.MustCompile(`\S+`)
 )
 
+// ProgramMetric is a single row of the running or queued programs table.
+// For queued programs Used is the number of processors requested.
 type ProgramMetric struct {
 	User    string
+	PID     string
+	Host    string
 	Program string
+	Started time.Time
 	Used    float64
+	Queued  bool
 }
 
 type ProgramCollector struct {
-	UserUsed *prometheus.Desc
-	target   string
-	logger   log.Logger
+	UserUsed           *prometheus.Desc
+	HostUsed           *prometheus.Desc
+	UserQueued         *prometheus.Desc
+	QueuedJobs         *prometheus.Desc
+	UserOldestStart    *prometheus.Desc
+	UserLongestRunning *prometheus.Desc
+	snapshot           *Snapshot
+	logger             log.Logger
 }
 
-func NewProgramExporter(target string, logger log.Logger) Collector {
+// NewProgramExporter returns a collector of the programs report of the snapshot's target.
+func NewProgramExporter(snapshot *Snapshot, logger log.Logger) Collector {
 	return &ProgramCollector{
 		UserUsed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "user_used"),
 			"Number of licenses used by a user for a given feature", []string{"feature", "user"}, nil),
-		target: target,
-		logger: logger,
+		HostUsed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "used"),
+			"Number of licenses used on a host for a given feature", []string{"feature", "host"}, nil),
+		UserQueued: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "user_queued"),
+			"Number of processors queued by a user for a given feature", []string{"feature", "user"}, nil),
+		QueuedJobs: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "queued_jobs"),
+			"Number of queued programs for a given feature", []string{"feature"}, nil),
+		UserOldestStart: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "user_oldest_start_timestamp_seconds"),
+			"Start time of the oldest running program of a user for a given feature", []string{"feature", "user"}, nil),
+		UserLongestRunning: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "user_longest_running_seconds"),
+			"Number of seconds the oldest running program of a user for a given feature has held licenses", []string{"feature", "user"}, nil),
+		snapshot: snapshot,
+		logger:   logger,
 	}
 }
 
 func (c *ProgramCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.UserUsed
+	ch <- c.HostUsed
+	ch <- c.UserQueued
+	ch <- c.QueuedJobs
+	ch <- c.UserOldestStart
+	ch <- c.UserLongestRunning
 }
 
 func (c *ProgramCollector) Collect(ch chan<- prometheus.Metric) {
@@ -63,86 +91,237 @@ func (c *ProgramCollector) Collect(ch chan<- prometheus.Metric) {
 	collectTime := time.Now()
 	timeout := 0
 	errorMetric := 0
-	metrics, err := c.collect()
-	if err == context.DeadlineExceeded {
-		level.Error(c.logger).Log("msg", "Timeout executing lstc_qrun")
+	metrics, hit, err := c.collect()
+	reason := errorReason(err)
+	if reason == reasonTimeout {
+		level.Error(c.logger).Log("msg", "Timeout executing lstc_qrun", "reason", reason)
 		timeout = 1
 	} else if err != nil {
-		level.Error(c.logger).Log("msg", err)
+		level.Error(c.logger).Log("msg", "Error collecting programs metrics", "reason", reason, "err", err)
 		errorMetric = 1
 	}
 
 	userUsed := make(map[string]map[string]float64)
+	hostUsed := make(map[string]map[string]float64)
+	userQueued := make(map[string]map[string]float64)
+	queuedJobs := make(map[string]float64)
+	userOldestStart := make(map[string]map[string]time.Time)
 	for _, m := range metrics {
+		if m.Queued {
+			if userQueued[m.Program] == nil {
+				userQueued[m.Program] = map[string]float64{}
+			}
+			userQueued[m.Program][m.User] += m.Used
+			queuedJobs[m.Program]++
+			continue
+		}
 		if userUsed[m.Program] == nil {
 			userUsed[m.Program] = map[string]float64{}
 		}
 		userUsed[m.Program][m.User] += m.Used
+		if hostUsed[m.Program] == nil {
+			hostUsed[m.Program] = map[string]float64{}
+		}
+		hostUsed[m.Program][m.Host] += m.Used
+		if m.Started.IsZero() {
+			continue
+		}
+		if userOldestStart[m.Program] == nil {
+			userOldestStart[m.Program] = map[string]time.Time{}
+		}
+		if started, ok := userOldestStart[m.Program][m.User]; !ok || m.Started.Before(started) {
+			userOldestStart[m.Program][m.User] = m.Started
+		}
 	}
 	for program, usermap := range userUsed {
 		for user, used := range usermap {
 			ch <- prometheus.MustNewConstMetric(c.UserUsed, prometheus.GaugeValue, used, program, user)
 		}
 	}
+	now := timeNow()
+	for program, usermap := range userOldestStart {
+		for user, started := range usermap {
+			ch <- prometheus.MustNewConstMetric(c.UserOldestStart, prometheus.GaugeValue, float64(started.Unix()), program, user)
+			ch <- prometheus.MustNewConstMetric(c.UserLongestRunning, prometheus.GaugeValue, now.Sub(started).Seconds(), program, user)
+		}
+	}
+	if *programHostUsed {
+		for program, hostmap := range hostUsed {
+			for host, used := range hostmap {
+				ch <- prometheus.MustNewConstMetric(c.HostUsed, prometheus.GaugeValue, used, program, host)
+			}
+		}
+	}
+	for program, usermap := range userQueued {
+		for user, queued := range usermap {
+			ch <- prometheus.MustNewConstMetric(c.UserQueued, prometheus.GaugeValue, queued, program, user)
+		}
+	}
+	for program, jobs := range queuedJobs {
+		ch <- prometheus.MustNewConstMetric(c.QueuedJobs, prometheus.GaugeValue, jobs, program)
+	}
 
 	ch <- prometheus.MustNewConstMetric(collectError, prometheus.GaugeValue, float64(errorMetric), "program")
 	ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, float64(timeout), "program")
+	ch <- prometheus.MustNewConstMetric(collectAttempts, prometheus.GaugeValue, float64(c.snapshot.program.attempts), "program")
+	ch <- prometheus.MustNewConstMetric(cacheHit, prometheus.GaugeValue, boolToFloat64(hit), "program")
+	collectErrorReasonMetrics(ch, "program", reason)
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "program")
 }
 
-func (c *ProgramCollector) collect() ([]ProgramMetric, error) {
-	var err error
-	var out string
-	var metrics []ProgramMetric
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*programTimeout)*time.Second)
-	defer cancel()
-	out, err = Lstc_qrun_pExec(c.target, ctx)
-	if ctx.Err() == context.DeadlineExceeded {
-		return nil, ctx.Err()
-	}
+// collect returns the programs report, or the cached report of the target when
+// the report failed and --exporter.use-cache is set.
+func (c *ProgramCollector) collect() ([]ProgramMetric, bool, error) {
+	metrics, err := c.snapshot.programs()
 	if err != nil {
-		return nil, err
+		if *exporterUseCache {
+			if cached, ok := programCache.read(c.snapshot.target); ok {
+				return cached, true, err
+			}
+		}
+		return metrics, false, err
 	}
-	metrics, err = lstc_qrun_p_parse(out, c.logger)
-	if err != nil {
-		return nil, err
+	if *exporterUseCache {
+		if err := programCache.write(c.snapshot.target, metrics); err != nil {
+			level.Warn(c.logger).Log("msg", "Error saving cached programs metrics", "err", err)
+		}
 	}
-	return metrics, nil
-}
-
-func lstc_qrun_p(target string, ctx context.Context) (string, error) {
-	cmd := execCommand(ctx, *lstc_qrun, "-s", target, "-p")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	// Non-errors have non-zero exit status, so ignore errors
-	_ = cmd.Run()
-	output := out.String()
-	re := regexp.MustCompile(`.*ERROR (.*)`)
-	match := re.FindStringSubmatch(output)
-	if len(match) == 2 {
-		return "", errors.New(match[1])
-	}
-	return output, nil
+	return metrics, false, nil
 }
 
+// lstc_qrun_p_parse parses the programs report. Each table's columns are found
+// from its header line and fields are read by position, so values containing
+// spaces such as the start time do not shift the other columns. Rows following
+// the "Queued Programs" title are marked as queued.
 func lstc_qrun_p_parse(out string, logger log.Logger) ([]ProgramMetric, error) {
 	var metrics []ProgramMetric
-	var err error
+	var columns []programColumn
+	location, err := time.LoadLocation(*featureTimezone)
+	if err != nil {
+		return nil, err
+	}
+	queued := false
+	inTable := false
+	now := timeNow()
 	lines := strings.Split(out, "\n")
 	for _, l := range lines {
-		items := strings.Fields(l)
-		if len(items) != 8 {
+		trimmed := strings.TrimSpace(l)
+		switch {
+		case trimmed == "Running Programs" || trimmed == "Queued Programs":
+			queued = trimmed == "Queued Programs"
+			columns = nil
+			inTable = false
+			continue
+		case trimmed == "" || strings.HasPrefix(trimmed, "No programs"):
+			inTable = false
+			continue
+		case columns == nil && strings.Contains(l, "User") && strings.Contains(l, "Program"):
+			columns = parseProgramColumns(l)
+			continue
+		case columns != nil && strings.Trim(trimmed, "-") == "":
+			inTable = true
+			continue
+		case !inTable:
 			continue
 		}
-		var metric ProgramMetric
-		metric.User = items[0]
-		metric.Program = items[2]
-		metric.Used, err = strconv.ParseFloat(items[7], 64)
+		metric, err := parseProgramRow(l, columns, now, location)
 		if err != nil {
-			level.Error(logger).Log("msg", "error converting to float", "line", l, "item", items[7])
+			level.Debug(logger).Log("msg", "Skipping program line", "line", l, "err", err)
+			parseSkippedLines.WithLabelValues("program").Inc()
 			continue
 		}
+		metric.Queued = queued
 		metrics = append(metrics, metric)
 	}
 	return metrics, nil
 }
+
+type programColumn struct {
+	name  string
+	start int
+	end   int
+}
+
+// parseProgramColumns finds the columns of a programs table header. Column
+// titles are separated by at least two spaces, "# procs" is a single title.
+func parseProgramColumns(header string) []programColumn {
+	var columns []programColumn
+	for _, loc := range programColumnRe.FindAllStringIndex(header, -1) {
+		columns = append(columns, programColumn{
+			name:  strings.ToLower(header[loc[0]:loc[1]]),
+			start: loc[0],
+			end:   loc[1],
+		})
+	}
+	return columns
+}
+
+// parseProgramRow assigns each field of a row to the column whose title is
+// nearest. Values are not always aligned with their titles, for example the
+// Host column is wider than its title, so the boundary between two columns is
+// the middle of the gap between their titles and a field belongs to the column
+// its midpoint falls in.
+func parseProgramRow(line string, columns []programColumn, now time.Time, location *time.Location) (ProgramMetric, error) {
+	var metric ProgramMetric
+	values := make([][]string, len(columns))
+	for _, loc := range programFieldRe.FindAllStringIndex(line, -1) {
+		middle := (loc[0] + loc[1]) / 2
+		i := 0
+		for i < len(columns)-1 && middle >= (columns[i].end+columns[i+1].start)/2 {
+			i++
+		}
+		values[i] = append(values[i], line[loc[0]:loc[1]])
+	}
+	fields := make(map[string]string)
+	for i, c := range columns {
+		fields[c.name] = strings.Join(values[i], " ")
+	}
+	for _, name := range []string{"user", "host", "program", "# procs"} {
+		if fields[name] == "" {
+			return metric, fmt.Errorf("missing %s", name)
+		}
+	}
+	for _, name := range []string{"user", "host", "program"} {
+		if strings.Contains(fields[name], " ") {
+			return metric, fmt.Errorf("unexpected %s %q", name, fields[name])
+		}
+	}
+	var err error
+	metric.User = fields["user"]
+	metric.PID, metric.Host = parseProgramHost(fields["host"])
+	metric.Program = fields["program"]
+	metric.Used, err = strconv.ParseFloat(fields["# procs"], 64)
+	if err != nil {
+		return metric, err
+	}
+	if started, ok := fields["started"]; ok {
+		// An unparsable start time only prevents the runtime metrics
+		metric.Started, _ = parseProgramStarted(started, now, location)
+	}
+	return metric, nil
+}
+
+// parseProgramHost splits the Host column, formatted as pid@hostname.
+func parseProgramHost(value string) (string, string) {
+	if pid, host, found := strings.Cut(value, "@"); found {
+		return pid, host
+	}
+	return "", value
+}
+
+// parseProgramStarted parses the Started column, such as "Tue Mar 17 16:18",
+// in the license server's timezone. The year is not printed so it is taken
+// from now, and a start time that would be in the future is assumed to be
+// from the previous year.
+func parseProgramStarted(value string, now time.Time, location *time.Location) (time.Time, error) {
+	started, err := time.ParseInLocation("Mon Jan 2 15:04", value, location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now = now.In(location)
+	started = time.Date(now.Year(), started.Month(), started.Day(), started.Hour(), started.Minute(), 0, 0, location)
+	if started.After(now.Add(24 * time.Hour)) {
+		started = started.AddDate(-1, 0, 0)
+	}
+	return started, nil
+}
@@ -16,13 +16,13 @@ package collector
 import (
 	"context"
 	"fmt"
-	"os/exec"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -39,10 +39,32 @@ Using user specified server 31011@haswell2
 sciappst    85606@o0579.ten.osc.ed MPPDYNA          Tue Mar 17 16:22    10
 No programs queued
 
+`
+	programQueuedStdout = `
+Using user specified server 31011@haswell2
+
+
+                     Running Programs
+
+    User             Host          Program              Started       # procs
+-----------------------------------------------------------------------------
+     hna    84212@o0284.ten.osc.ed MPPDYNA          Tue Mar 17 16:18    28
+sciappst    85606@o0579.ten.osc.ed MPPDYNA          Tue Mar 17 16:22    10
+
+                     Queued Programs
+
+    User             Host          Program              Started       # procs
+-----------------------------------------------------------------------------
+     hna    84390@o0301.ten.osc.ed MPPDYNA          Tue Mar 17 16:40    48
+     hna    84391@o0302.ten.osc.ed MPPDYNA          Tue Mar 17 16:41    16
+   jdoe     91022@p0112.ten.osc.ed LS-DYNA          Tue Mar 17 16:45     4
+
 `
 )
 
 func TestProgramParse(t *testing.T) {
+	mockNow, _ := time.Parse("01/02/2006 15:04", "03/18/2020 10:00")
+	timeNow = func() time.Time { return mockNow }
 	metrics, err := lstc_qrun_p_parse(programStdout, log.NewNopLogger())
 	if err != nil {
 		t.Errorf("Unexpected err: %s", err.Error())
@@ -55,19 +77,63 @@ func TestProgramParse(t *testing.T) {
 	if val := metrics[0].User; val != "hna" {
 		t.Errorf("Unexpected name %v", val)
 	}
+	if val := metrics[0].PID; val != "84212" {
+		t.Errorf("Unexpected pid %v", val)
+	}
+	if val := metrics[0].Host; val != "o0284.ten.osc.ed" {
+		t.Errorf("Unexpected host %v", val)
+	}
 	if val := metrics[0].Program; val != "MPPDYNA" {
 		t.Errorf("Unexpected program %v", val)
 	}
+	if val := metrics[0].Started.Format(time.RFC3339); val != "2020-03-17T16:18:00Z" {
+		t.Errorf("Unexpected started %v", val)
+	}
 	if val := metrics[0].Used; val != 28 {
 		t.Errorf("Unexpected used %v", val)
 	}
+	for _, m := range metrics {
+		if m.Queued {
+			t.Errorf("Unexpected queued program %v", m)
+		}
+	}
+}
+
+func TestProgramParseQueued(t *testing.T) {
+	metrics, err := lstc_qrun_p_parse(programQueuedStdout, log.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err.Error())
+		return
+	}
+	if len(metrics) != 5 {
+		t.Errorf("Expected 5 metrics, got %d", len(metrics))
+		return
+	}
+	if metrics[1].Queued {
+		t.Errorf("Expected running program %v", metrics[1])
+	}
+	if !metrics[2].Queued {
+		t.Errorf("Expected queued program %v", metrics[2])
+	}
+	if val := metrics[4].User; val != "jdoe" {
+		t.Errorf("Unexpected user %v", val)
+	}
+	if val := metrics[4].Program; val != "LS-DYNA" {
+		t.Errorf("Unexpected program %v", val)
+	}
+	if val := metrics[4].Used; val != 4 {
+		t.Errorf("Unexpected used %v", val)
+	}
 }
 
 func TestProgramCollector(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
-	Lstc_qrun_pExec = func(target string, ctx context.Context) (string, error) {
+	mockNow, _ := time.Parse("01/02/2006 15:04", "03/18/2020 10:00")
+	timeNow = func() time.Time { return mockNow }
+	runner.programs = func(ctx context.Context, target string) (string, error) {
 		return programStdout, nil
 	}
 	expected := `
@@ -81,25 +147,209 @@ func TestProgramCollector(t *testing.T) {
 	# TYPE lsdyna_feature_user_used gauge
 	lsdyna_feature_user_used{feature="MPPDYNA", user="hna"} 28
 	lsdyna_feature_user_used{feature="MPPDYNA", user="sciappst"} 10
+	# HELP lsdyna_feature_user_longest_running_seconds Number of seconds the oldest running program of a user for a given feature has held licenses
+	# TYPE lsdyna_feature_user_longest_running_seconds gauge
+	lsdyna_feature_user_longest_running_seconds{feature="MPPDYNA", user="hna"} 63720
+	lsdyna_feature_user_longest_running_seconds{feature="MPPDYNA", user="sciappst"} 63480
+	# HELP lsdyna_feature_user_oldest_start_timestamp_seconds Start time of the oldest running program of a user for a given feature
+	# TYPE lsdyna_feature_user_oldest_start_timestamp_seconds gauge
+	lsdyna_feature_user_oldest_start_timestamp_seconds{feature="MPPDYNA", user="hna"} 1584461880
+	lsdyna_feature_user_oldest_start_timestamp_seconds{feature="MPPDYNA", user="sciappst"} 1584462120
 	`
-	collector := NewProgramExporter("localhost", log.NewNopLogger())
+	collector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 5 {
-		t.Errorf("Unexpected collection count %d, expected 5", val)
+	} else if val != 20 {
+		t.Errorf("Unexpected collection count %d, expected 20", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
-		"lsdyna_feature_user_used", "lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
+		"lsdyna_feature_user_used", "lsdyna_feature_user_queued", "lsdyna_feature_queued_jobs",
+		"lsdyna_feature_user_longest_running_seconds", "lsdyna_feature_user_oldest_start_timestamp_seconds",
+		"lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestProgramParseColumns(t *testing.T) {
+	mockNow, _ := time.Parse("01/02/2006 15:04", "03/18/2020 10:00")
+	timeNow = func() time.Time { return mockNow }
+	out := `
+Using user specified server 31011@haswell2
+
+
+                     Running Programs
+
+    User             Host          Program              Started       # procs
+-----------------------------------------------------------------------------
+ j.doe-2    84212@o0284.ten.osc.ed MPPDYNA          Sat Mar  7 06:18    28
+verylonguser 1@p0001.pitzer.osc.edu LS-DYNA         Tue Mar 17 16:22     1
+     hna    84390@o0301.ten.osc.ed MPPDYNA          Tue Mar 17 16:40   abc
+garbage
+No programs queued
+
+`
+	skipped := testutil.ToFloat64(parseSkippedLines.WithLabelValues("program"))
+	metrics, err := lstc_qrun_p_parse(out, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(metrics))
+	}
+	if val := metrics[0].User; val != "j.doe-2" {
+		t.Errorf("Unexpected user %v", val)
+	}
+	if val := metrics[0].Started.Format(time.RFC3339); val != "2020-03-07T06:18:00Z" {
+		t.Errorf("Unexpected started %v", val)
+	}
+	if val := metrics[0].Used; val != 28 {
+		t.Errorf("Unexpected used %v", val)
+	}
+	if val := metrics[1].User; val != "verylonguser" {
+		t.Errorf("Unexpected user %v", val)
+	}
+	if val := metrics[1].Host; val != "p0001.pitzer.osc.edu" {
+		t.Errorf("Unexpected host %v", val)
+	}
+	if val := metrics[1].Program; val != "LS-DYNA" {
+		t.Errorf("Unexpected program %v", val)
+	}
+	if val := metrics[1].Used; val != 1 {
+		t.Errorf("Unexpected used %v", val)
+	}
+	if val := testutil.ToFloat64(parseSkippedLines.WithLabelValues("program")) - skipped; val != 2 {
+		t.Errorf("Unexpected skipped lines %v", val)
+	}
+}
+
+func TestProgramParseTimezone(t *testing.T) {
+	timezone := "America/New_York"
+	previous := featureTimezone
+	featureTimezone = &timezone
+	defer func() {
+		timeNow = time.Now
+		featureTimezone = previous
+	}()
+	mockNow, _ := time.Parse(time.RFC3339, "2020-03-17T21:00:00Z")
+	timeNow = func() time.Time { return mockNow }
+	metrics, err := lstc_qrun_p_parse(programStdout, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err.Error())
+	}
+	if val := metrics[0].Started.UTC().Format(time.RFC3339); val != "2020-03-17T20:18:00Z" {
+		t.Errorf("Unexpected started %v", val)
+	}
+}
+
+func TestParseProgramStarted(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Timezone database is not available: %s", err)
+	}
+	tests := []struct {
+		now      string
+		value    string
+		location *time.Location
+		expected string
+	}{
+		{now: "2020-03-18T10:00:00Z", value: "Tue Mar 17 16:18", location: time.UTC, expected: "2020-03-17T16:18:00Z"},
+		{now: "2020-03-18T10:00:00Z", value: "Wed Mar  4 09:05", location: time.UTC, expected: "2020-03-04T09:05:00Z"},
+		{now: "2021-01-02T08:00:00Z", value: "Thu Dec 31 23:10", location: time.UTC, expected: "2020-12-31T23:10:00Z"},
+		{now: "2020-12-31T23:50:00Z", value: "Fri Jan  1 00:05", location: time.UTC, expected: "2020-01-01T00:05:00Z"},
+		{now: "2020-03-18T10:00:00Z", value: "Tue Mar 17 16:18", location: newYork, expected: "2020-03-17T20:18:00Z"},
+		// Still the previous year on the license server
+		{now: "2021-01-01T02:00:00Z", value: "Thu Dec 31 20:10", location: newYork, expected: "2021-01-01T01:10:00Z"},
+		{now: "2021-01-01T02:00:00Z", value: "Fri Jan  1 00:05", location: newYork, expected: "2020-01-01T05:05:00Z"},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		started, err := parseProgramStarted(strings.Join(strings.Fields(test.value), " "), now, test.location)
+		if err != nil {
+			t.Errorf("Unexpected err for %q: %s", test.value, err.Error())
+			continue
+		}
+		if val := started.UTC().Format(time.RFC3339); val != test.expected {
+			t.Errorf("Unexpected started for %q in %s, got %s expected %s", test.value, test.location, val, test.expected)
+		}
+	}
+	if _, err := parseProgramStarted("not a date", time.Now(), time.UTC); err == nil {
+		t.Errorf("Expected error parsing invalid start time")
+	}
+}
+
+func TestProgramCollectorQueued(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return programQueuedStdout, nil
+	}
+	expected := `
+	# HELP lsdyna_feature_queued_jobs Number of queued programs for a given feature
+	# TYPE lsdyna_feature_queued_jobs gauge
+	lsdyna_feature_queued_jobs{feature="LS-DYNA"} 1
+	lsdyna_feature_queued_jobs{feature="MPPDYNA"} 2
+	# HELP lsdyna_feature_user_queued Number of processors queued by a user for a given feature
+	# TYPE lsdyna_feature_user_queued gauge
+	lsdyna_feature_user_queued{feature="LS-DYNA", user="jdoe"} 4
+	lsdyna_feature_user_queued{feature="MPPDYNA", user="hna"} 64
+	# HELP lsdyna_feature_user_used Number of licenses used by a user for a given feature
+	# TYPE lsdyna_feature_user_used gauge
+	lsdyna_feature_user_used{feature="MPPDYNA", user="hna"} 28
+	lsdyna_feature_user_used{feature="MPPDYNA", user="sciappst"} 10
+	`
+	collector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 24 {
+		t.Errorf("Unexpected collection count %d, expected 24", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
+		"lsdyna_feature_user_used", "lsdyna_feature_user_queued", "lsdyna_feature_queued_jobs"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestProgramCollectorHostUsed(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	hostUsed := true
+	programHostUsed = &hostUsed
+	defer func() {
+		hostUsed = false
+	}()
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return programQueuedStdout, nil
+	}
+	expected := `
+	# HELP lsdyna_host_used Number of licenses used on a host for a given feature
+	# TYPE lsdyna_host_used gauge
+	lsdyna_host_used{feature="MPPDYNA", host="o0284.ten.osc.ed"} 28
+	lsdyna_host_used{feature="MPPDYNA", host="o0579.ten.osc.ed"} 10
+	`
+	collector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	gatherers := setupGatherer(collector)
+	if val, err := testutil.GatherAndCount(gatherers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 26 {
+		t.Errorf("Unexpected collection count %d, expected 26", val)
+	}
+	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "lsdyna_host_used"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
 
 func TestProgramCollectorError(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
-	Lstc_qrun_pExec = func(target string, ctx context.Context) (string, error) {
+	runner.programs = func(ctx context.Context, target string) (string, error) {
 		return "", fmt.Errorf("Error")
 	}
 	expected := `
@@ -110,12 +360,12 @@ func TestProgramCollectorError(t *testing.T) {
     # TYPE lsdyna_exporter_collect_timeout gauge
     lsdyna_exporter_collect_timeout{collector="program"} 0
 	`
-	collector := NewProgramExporter("localhost", log.NewNopLogger())
+	collector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 14 {
+		t.Errorf("Unexpected collection count %d, expected 14", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"lsdyna_feature_user_used", "lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
@@ -124,10 +374,11 @@ func TestProgramCollectorError(t *testing.T) {
 }
 
 func TestProgramCollectorTimeout(t *testing.T) {
+	runner := &fakeRunner{}
 	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
 		t.Fatal(err)
 	}
-	Lstc_qrun_pExec = func(target string, ctx context.Context) (string, error) {
+	runner.programs = func(ctx context.Context, target string) (string, error) {
 		return "", context.DeadlineExceeded
 	}
 	expected := `
@@ -138,12 +389,12 @@ func TestProgramCollectorTimeout(t *testing.T) {
     # TYPE lsdyna_exporter_collect_timeout gauge
     lsdyna_exporter_collect_timeout{collector="program"} 1
 	`
-	collector := NewProgramExporter("localhost", log.NewNopLogger())
+	collector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 3 {
-		t.Errorf("Unexpected collection count %d, expected 3", val)
+	} else if val != 14 {
+		t.Errorf("Unexpected collection count %d, expected 14", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected),
 		"lsdyna_feature_user_used", "lsdyna_exporter_collect_error", "lsdyna_exporter_collect_timeout"); err != nil {
@@ -151,37 +402,51 @@ func TestProgramCollectorTimeout(t *testing.T) {
 	}
 }
 
-func Test_lstc_qrun_exec(t *testing.T) {
-	execCommand = fakeExecCommand
-	mockedExitStatus = 0
-	mockedStdout = "foo"
-	defer func() { execCommand = exec.CommandContext }()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	out, err := lstc_qrun_p("host", ctx)
-	if err != nil {
-		t.Errorf("Unexpected error: %s", err.Error())
+func TestProgramCollectorCache(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
 	}
-	if out != mockedStdout {
-		t.Errorf("Unexpected out: %s", out)
+	useCache := true
+	exporterUseCache = &useCache
+	defer func() {
+		useCache = false
+	}()
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return programStdout, nil
 	}
-}
-
-func Test_lstc_qrun_execError(t *testing.T) {
-	execCommand = fakeExecCommand
-	mockedExitStatus = 0
-	mockedStdout = "  ERROR some error"
-	defer func() { execCommand = exec.CommandContext }()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	out, err := lstc_qrun_p("host", ctx)
-	if err == nil {
-		t.Errorf("Should have returned error")
-	}
-	if err != nil && err.Error() != "some error" {
-		t.Errorf("Unexpected error message")
-	}
-	if out != "" {
-		t.Errorf("Unexpected out: %s", out)
+	expected := `
+	# HELP lsdyna_feature_user_used Number of licenses used by a user for a given feature
+	# TYPE lsdyna_feature_user_used gauge
+	lsdyna_feature_user_used{feature="MPPDYNA",user="hna"} 28
+	lsdyna_feature_user_used{feature="MPPDYNA",user="sciappst"} 10
+	`
+	cacheMetric := `
+	# HELP lsdyna_exporter_cache_hit Indicates the collector served cached metrics after an error
+	# TYPE lsdyna_exporter_cache_hit gauge
+	lsdyna_exporter_cache_hit{collector="program"} %d
+	# HELP lsdyna_exporter_collect_timeout Indicates the collector timed out
+	# TYPE lsdyna_exporter_collect_timeout gauge
+	lsdyna_exporter_collect_timeout{collector="program"} %d
+	`
+	// Each scrape collects a new snapshot
+	gatherer := func(target string) prometheus.Gatherer {
+		return setupGatherer(NewProgramExporter(NewSnapshot(context.Background(), target, runner, log.NewNopLogger()), log.NewNopLogger()))
+	}
+	if err := testutil.GatherAndCompare(gatherer("31011@haswell2"), strings.NewReader(fmt.Sprintf(cacheMetric, 0, 0)+expected),
+		"lsdyna_feature_user_used", "lsdyna_exporter_cache_hit", "lsdyna_exporter_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return "", context.DeadlineExceeded
+	}
+	if err := testutil.GatherAndCompare(gatherer("31011@haswell2"), strings.NewReader(fmt.Sprintf(cacheMetric, 1, 1)+expected),
+		"lsdyna_feature_user_used", "lsdyna_exporter_cache_hit", "lsdyna_exporter_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	// A target that was never collected has nothing cached
+	if err := testutil.GatherAndCompare(gatherer("31011@uncached"), strings.NewReader(fmt.Sprintf(cacheMetric, 0, 1)),
+		"lsdyna_feature_user_used", "lsdyna_exporter_cache_hit", "lsdyna_exporter_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
@@ -0,0 +1,299 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	lstcQrunMaxOutput = kingpin.Flag("lstc_qrun.max-output",
+		"Maximum size of lstc_qrun stdout and stderr that is captured, 0 for no limit").Default("1MiB").Bytes()
+	lstcQrunMemoryLimit = kingpin.Flag("lstc_qrun.memory-limit",
+		"Limit of lstc_qrun virtual memory, 0 for no limit").Default("0").Bytes()
+	lstcQrunCPUTimeLimit = kingpin.Flag("lstc_qrun.cpu-time-limit",
+		"Limit of lstc_qrun CPU time, 0 for no limit").Default("0s").Duration()
+	lstcQrunNice = kingpin.Flag("lstc_qrun.nice", "Nice level of lstc_qrun").Default("0").Int()
+	// lstcQrunWaitDelay is how long to wait for output after the process group is killed
+	lstcQrunWaitDelay = time.Second
+	lstcQrunKilled    = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "lstc_qrun_killed_total",
+		Help:      "Number of lstc_qrun invocations killed after reaching the collector timeout",
+	}, []string{"collector"})
+)
+
+// Runner returns the lstc_qrun feature (-r) and programs (-p) reports of a target.
+type Runner interface {
+	Features(ctx context.Context, target string) (string, error)
+	Programs(ctx context.Context, target string) (string, error)
+}
+
+// LstcQrunRunner runs the lstc_qrun binary.
+type LstcQrunRunner struct {
+	command     lstcQrunCommand
+	execCommand func(ctx context.Context, name string, arg ...string) *exec.Cmd
+}
+
+// NewLstcQrunRunner returns a Runner for the lstc_qrun binary at path.
+func NewLstcQrunRunner(path string) *LstcQrunRunner {
+	return &LstcQrunRunner{
+		command:     lstcQrunCommand{path: path},
+		execCommand: exec.CommandContext,
+	}
+}
+
+func defaultRunner(runner Runner) Runner {
+	if runner == nil {
+		return NewLstcQrunRunner(*lstc_qrun)
+	}
+	return runner
+}
+
+// TargetRunner runs each target with the runner its configuration selects,
+// targets without configuration use the local lstc_qrun binary as is.
+type TargetRunner struct {
+	local   Runner
+	targets map[string]Runner
+}
+
+// NewTargetRunner returns a TargetRunner for config, runners are created once
+// so their connections are reused across scrapes.
+func NewTargetRunner(config *Config) (*TargetRunner, error) {
+	r := &TargetRunner{
+		local:   NewLstcQrunRunner(*lstc_qrun),
+		targets: make(map[string]Runner),
+	}
+	for target, t := range config.Targets {
+		if t.SSH == nil {
+			runner := NewLstcQrunRunner(*lstc_qrun)
+			runner.command = t.command(*lstc_qrun)
+			r.targets[target] = runner
+			continue
+		}
+		runner, err := NewSSHRunner(t)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure ssh of target %s: %w", target, err)
+		}
+		r.targets[target] = runner
+	}
+	return r, nil
+}
+
+func (r *TargetRunner) runner(target string) Runner {
+	if runner, ok := r.targets[target]; ok {
+		return runner
+	}
+	return r.local
+}
+
+func (r *TargetRunner) Features(ctx context.Context, target string) (string, error) {
+	return r.runner(target).Features(ctx, target)
+}
+
+func (r *TargetRunner) Programs(ctx context.Context, target string) (string, error) {
+	return r.runner(target).Programs(ctx, target)
+}
+
+// ExecError is an lstc_qrun invocation that failed or reported an error.
+type ExecError struct {
+	ExitCode int
+	Message  string
+	Stderr   string
+	Err      error
+}
+
+func (e *ExecError) Error() string {
+	var parts []string
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	} else if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		parts = append(parts, stderr)
+	}
+	return strings.Join(parts, ": ")
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+func (r *LstcQrunRunner) Features(ctx context.Context, target string) (string, error) {
+	out, stderr, err := r.run(ctx, "feature", featuresArgs(target)...)
+	return featuresResult(out, stderr, err)
+}
+
+func (r *LstcQrunRunner) Programs(ctx context.Context, target string) (string, error) {
+	out, stderr, err := r.run(ctx, "program", programsArgs(target)...)
+	return programsResult(out, stderr, err)
+}
+
+func featuresArgs(target string) []string {
+	return []string{"-r", "-s", target}
+}
+
+func programsArgs(target string) []string {
+	return []string{"-s", target, "-p"}
+}
+
+// featuresResult returns the feature report or the error of an lstc_qrun -r invocation.
+func featuresResult(out string, stderr string, err error) (string, error) {
+	if exitCode, ok := exitStatus(err); ok {
+		return "", &ExecError{ExitCode: exitCode, Message: outputError(out), Stderr: stderr, Err: err}
+	} else if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// programsResult returns the programs report or the error of an lstc_qrun -p invocation.
+func programsResult(output string, stderr string, err error) (string, error) {
+	exitCode, exited := exitStatus(err)
+	// Non-errors have non-zero exit status, so only fail when there is no output
+	if exited {
+		if strings.TrimSpace(output) == "" && strings.TrimSpace(stderr) != "" {
+			return "", &ExecError{ExitCode: exitCode, Stderr: stderr, Err: err}
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if message := outputError(output); message != "" {
+		return "", &ExecError{ExitCode: exitCode, Message: message, Stderr: stderr}
+	}
+	return output, nil
+}
+
+// exitStatus returns the exit status of an lstc_qrun that ran and exited non-zero.
+func exitStatus(err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), true
+	}
+	var sshExitErr *ssh.ExitError
+	if errors.As(err, &sshExitErr) {
+		return sshExitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// outputError returns the message of an ERROR line lstc_qrun printed.
+func outputError(output string) string {
+	re := regexp.MustCompile(`.*ERROR (.*)`)
+	match := re.FindStringSubmatch(output)
+	if len(match) == 2 {
+		return strings.TrimSpace(match[1])
+	}
+	return ""
+}
+
+// run executes lstc_qrun in its own process group so the whole group,
+// including any helpers lstc_qrun starts, is killed when ctx is done.
+// The environment of the target is added to the exporter's environment.
+// Resource limits are applied by the limits helper before lstc_qrun is executed.
+func (r *LstcQrunRunner) run(ctx context.Context, collector string, args ...string) (string, string, error) {
+	name, arguments := r.command.path, r.command.arguments(args...)
+	env := r.command.env
+	limits := processLimits{
+		memory:  uint64(*lstcQrunMemoryLimit),
+		cpuTime: *lstcQrunCPUTimeLimit,
+		nice:    *lstcQrunNice,
+	}
+	if limits != (processLimits{}) {
+		var limitsEnv string
+		var err error
+		name, arguments, limitsEnv, err = limitsCommand(limits, name, arguments)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to limit lstc_qrun: %w", err)
+		}
+		env = append(append([]string{}, env...), limitsEnv)
+	}
+	cmd := r.execCommand(ctx, name, arguments...)
+	cmd.Dir = r.command.dir
+	if len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	stdout := &limitedBuffer{limit: int(*lstcQrunMaxOutput)}
+	stderr := &limitedBuffer{limit: int(*lstcQrunMaxOutput)}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		lstcQrunKilled.WithLabelValues(collector).Inc()
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = lstcQrunWaitDelay
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	err := cmd.Wait()
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+	if stdout.exceeded || stderr.exceeded {
+		return "", "", &ExecError{Message: fmt.Sprintf("lstc_qrun output exceeded %d bytes", stdout.limit)}
+	}
+	return stdout.String(), stderr.String(), err
+}
+
+// processLimits are resource limits applied to lstc_qrun, zero values are not applied.
+type processLimits struct {
+	memory  uint64
+	cpuTime time.Duration
+	nice    int
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest,
+// so a misbehaving lstc_qrun cannot grow the exporter's memory.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return b.buf.Write(p)
+	}
+	remaining := b.limit - b.buf.Len()
+	if len(p) > remaining {
+		b.exceeded = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// limitsEnv marks the exporter re-executed as the helper that applies the
+// limits of lstc_qrun before executing it.
+const limitsEnv = "LSDYNA_EXPORTER_LSTC_QRUN_LIMITS"
+
+// limitsExecutable is the exporter binary that is re-executed as the helper.
+var limitsExecutable = os.Executable
+
+// limitsCommand returns the command that runs path through the limits helper,
+// so lstc_qrun and every process it starts run with the limits from the start.
+func limitsCommand(limits processLimits, path string, args []string) (string, []string, string, error) {
+	executable, err := limitsExecutable()
+	if err != nil {
+		return "", nil, "", err
+	}
+	seconds := uint64(math.Ceil(limits.cpuTime.Seconds()))
+	env := fmt.Sprintf("%s=%d,%d,%d", limitsEnv, limits.memory, seconds, limits.nice)
+	return executable, append([]string{path}, args...), env, nil
+}
+
+// LimitsHelper executes lstc_qrun with its limits applied when the exporter
+// was started as the limits helper, otherwise it returns. It is called at the
+// start of main before flags are parsed.
+func LimitsHelper() {
+	value, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	if err := execWithLimits(value, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to run lstc_qrun with limits: %s\n", err)
+		// Exit like a shell that cannot execute the command
+		os.Exit(126)
+	}
+}
+
+func execWithLimits(value string, args []string) error {
+	var memory, cpuTime uint64
+	var nice int
+	if _, err := fmt.Sscanf(value, "%d,%d,%d", &memory, &cpuTime, &nice); err != nil {
+		return fmt.Errorf("invalid limits %q: %w", value, err)
+	}
+	if len(args) == 0 {
+		return errors.New("missing lstc_qrun path")
+	}
+	// The nice level is a property of the thread, exec from the thread that set it
+	runtime.LockOSThread()
+	if memory > 0 {
+		if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: memory, Max: memory}); err != nil {
+			return err
+		}
+	}
+	if cpuTime > 0 {
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: cpuTime, Max: cpuTime}); err != nil {
+			return err
+		}
+	}
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice); err != nil {
+			return err
+		}
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, limitsEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	return syscall.Exec(path, args, env)
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// TestMain lets the test binary act as the limits helper like the exporter.
+func TestMain(m *testing.M) {
+	LimitsHelper()
+	os.Exit(m.Run())
+}
+
+func TestLstcQrunRunnerLimits(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--lstc_qrun.memory-limit=4GiB",
+		"--lstc_qrun.cpu-time-limit=10s", "--lstc_qrun.nice=5"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	niceOut, err := exec.Command("nice").Output()
+	if err != nil {
+		t.Skipf("nice is not available: %s", err)
+	}
+	nice, _ := strconv.Atoi(strings.TrimSpace(string(niceOut)))
+	// The limits are reported by a process lstc_qrun starts
+	script := filepath.Join(t.TempDir(), "lstc_qrun")
+	content := "#!/bin/sh\nsh -c 'echo \"$(ulimit -v) $(ulimit -t) $(nice) ${" + limitsEnv + ":-unset}\"'\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewLstcQrunRunner(script)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := runner.Features(ctx, "host")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := fmt.Sprintf("4194304 10 %d unset", nice+5)
+	if strings.TrimSpace(out) != expected {
+		t.Errorf("Unexpected limits %q, expected %q", strings.TrimSpace(out), expected)
+	}
+}
+
+func TestLstcQrunRunnerLimitsExecFailed(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--lstc_qrun.nice=5"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	runner := NewLstcQrunRunner("/dne")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runner.Features(ctx, "host")
+	if reason := errorReason(err); reason != "exec_failed" {
+		t.Errorf("Unexpected reason %s for %v", reason, err)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLstcQrunRunnerFeatures(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := runner.Features(ctx, "host")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != mockedStdout {
+		t.Errorf("Unexpected out: %s", out)
+	}
+}
+
+func TestLstcQrunRunnerPrograms(t *testing.T) {
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := runner.Programs(ctx, "host")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != mockedStdout {
+		t.Errorf("Unexpected out: %s", out)
+	}
+}
+
+func TestLstcQrunRunnerProgramsError(t *testing.T) {
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "  ERROR some error"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := runner.Programs(ctx, "host")
+	if err == nil {
+		t.Errorf("Should have returned error")
+	}
+	if err != nil && err.Error() != "some error" {
+		t.Errorf("Unexpected error message")
+	}
+	if out != "" {
+		t.Errorf("Unexpected out: %s", out)
+	}
+}
+
+func TestLstcQrunRunnerFeaturesError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 1
+	mockedStdout = ""
+	mockedStderr = "Unable to connect to 31011@haswell2: Connection refused"
+	defer func() {
+		mockedExitStatus = 0
+		mockedStderr = ""
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runner.Features(ctx, "host")
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if execErr.ExitCode != 1 {
+		t.Errorf("Unexpected exit code %d", execErr.ExitCode)
+	}
+	if !strings.Contains(err.Error(), mockedStderr) {
+		t.Errorf("Unexpected error message %s", err.Error())
+	}
+	if reason := errorReason(err); reason != "connection_refused" {
+		t.Errorf("Unexpected reason %s", reason)
+	}
+}
+
+func TestLstcQrunRunnerMissing(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewLstcQrunRunner("/dne")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runner.Programs(ctx, "host")
+	if reason := errorReason(err); reason != "exec_failed" {
+		t.Errorf("Unexpected reason %s for %v", reason, err)
+	}
+}
+
+func TestLstcQrunRunnerTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	mockedSleep = 30 * time.Second
+	mockedChildPidFile = filepath.Join(t.TempDir(), "child.pid")
+	defer func() {
+		mockedSleep = 0
+		mockedChildPidFile = ""
+	}()
+	killed := testutil.ToFloat64(lstcQrunKilled.WithLabelValues("feature"))
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runner.Features(ctx, "host")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lstc_qrun was not killed after timeout, took %s", elapsed)
+	}
+	if val := testutil.ToFloat64(lstcQrunKilled.WithLabelValues("feature")) - killed; val != 1 {
+		t.Errorf("Unexpected killed count %v", val)
+	}
+	data, err := os.ReadFile(mockedChildPidFile)
+	if err != nil {
+		t.Fatalf("Unable to read child pid: %s", err)
+	}
+	pid, _ := strconv.Atoi(string(data))
+	for i := 0; i < 50; i++ {
+		if !processRunning(pid) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("Child process %d of lstc_qrun was not killed", pid)
+}
+
+// processRunning returns false for processes that have exited, including zombies.
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func TestLstcQrunRunnerMaxOutput(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--lstc_qrun.max-output=8B"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	runner := NewLstcQrunRunner("/dne")
+	runner.execCommand = fakeExecCommand
+	mockedExitStatus = 0
+	mockedStdout = "more than eight bytes"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := runner.Features(ctx, "host"); err == nil {
+		t.Errorf("Expected error for output exceeding limit")
+	}
+}
+
+func TestLstcQrunRunnerTargetCommand(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	target := &TargetConfig{
+		LstcQrun:   "/opt/lstc/R11/lstc_qrun",
+		Args:       []string{"-R"},
+		Env:        map[string]string{"STDOUT": "from target"},
+		WorkingDir: dir,
+	}
+	runner := NewLstcQrunRunner("/dne")
+	runner.command = target.command("/dne")
+	var cmd *exec.Cmd
+	runner.execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		cmd = fakeExecCommand(ctx, name, arg...)
+		return cmd
+	}
+	mockedExitStatus = 0
+	mockedStdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := runner.Features(ctx, "host")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if out != "from target" {
+		t.Errorf("Unexpected out: %s", out)
+	}
+	if args := strings.Join(cmd.Args[2:], " "); args != "-- /opt/lstc/R11/lstc_qrun -R -r -s host" {
+		t.Errorf("Unexpected args: %s", args)
+	}
+	if cmd.Dir != dir {
+		t.Errorf("Unexpected working directory: %s", cmd.Dir)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectorAllowMissingServer = kingpin.Flag("collector.allow-missing-server",
+		"Accept lstc_qrun output that does not report the server it used").Default("false").Bool()
+	serverInfo = prometheus.NewDesc(prometheus.BuildFQName(namespace, "server", "info"),
+		"License server reported by lstc_qrun", []string{"target", "server", "version"}, nil)
+	serverRe  = regexp.MustCompile(`^Using\b.*\bserver\s+(\S+)`)
+	versionRe = regexp.MustCompile(`(?i)\bversion:?\s+(\S+)`)
+)
+
+// ServerHeader is the license server and version lstc_qrun prints before its report.
+type ServerHeader struct {
+	Server  string
+	Version string
+}
+
+// ServerMismatchError is returned when lstc_qrun reports a different license
+// server than the requested target, such as when it falls back to a default server.
+// Server is empty when the output does not report a server.
+type ServerMismatchError struct {
+	Target string
+	Server string
+}
+
+func (e *ServerMismatchError) Error() string {
+	if e.Server == "" {
+		return fmt.Sprintf("lstc_qrun did not report the server used for target %s", e.Target)
+	}
+	return fmt.Sprintf("lstc_qrun used server %s instead of target %s", e.Server, e.Target)
+}
+
+// lstc_qrun_header_parse parses the lines printed before the report tables.
+func lstc_qrun_header_parse(out string) ServerHeader {
+	var header ServerHeader
+	for _, l := range strings.Split(out, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "LICENSE INFORMATION" || l == "Running Programs" {
+			break
+		}
+		if match := serverRe.FindStringSubmatch(l); match != nil {
+			header.Server = match[1]
+		} else if match := versionRe.FindStringSubmatch(l); match != nil && header.Version == "" {
+			header.Version = match[1]
+		}
+	}
+	return header
+}
+
+// verifyServer checks the server in the header is the target. Targets are
+// port@host or host, a missing port matches any port and a short hostname
+// matches its fully qualified name. Output without a server header is a
+// mismatch unless --collector.allow-missing-server is set.
+func verifyServer(target string, header ServerHeader) error {
+	if header.Server == "" {
+		if *collectorAllowMissingServer {
+			return nil
+		}
+		return &ServerMismatchError{Target: target}
+	}
+	targetPort, targetHost := splitServer(target)
+	serverPort, serverHost := splitServer(header.Server)
+	mismatch := &ServerMismatchError{Target: target, Server: header.Server}
+	if targetPort != "" && serverPort != "" && targetPort != serverPort {
+		return mismatch
+	}
+	if strings.EqualFold(targetHost, serverHost) {
+		return nil
+	}
+	targetShort, _, targetQualified := strings.Cut(targetHost, ".")
+	serverShort, _, serverQualified := strings.Cut(serverHost, ".")
+	if targetQualified != serverQualified && strings.EqualFold(targetShort, serverShort) {
+		return nil
+	}
+	return mismatch
+}
+
+func splitServer(server string) (string, string) {
+	if port, host, found := strings.Cut(server, "@"); found {
+		return port, host
+	}
+	return "", server
+}
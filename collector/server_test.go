@@ -0,0 +1,144 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServerHeaderParse(t *testing.T) {
+	header := lstc_qrun_header_parse(featureStdout)
+	if header.Server != "31011@haswell2" {
+		t.Errorf("Unexpected server %s", header.Server)
+	}
+	if header.Version != "" {
+		t.Errorf("Unexpected version %s", header.Version)
+	}
+	header = lstc_qrun_header_parse("\nLSTC License Manager version R11.1.0\nUsing user specified server 31010@license01\n\nLICENSE INFORMATION\n")
+	if header.Server != "31010@license01" {
+		t.Errorf("Unexpected server %s", header.Server)
+	}
+	if header.Version != "R11.1.0" {
+		t.Errorf("Unexpected version %s", header.Version)
+	}
+	header = lstc_qrun_header_parse("\nUsing default server 31010@localhost\n\nLICENSE INFORMATION\n")
+	if header.Server != "31010@localhost" {
+		t.Errorf("Unexpected server %s", header.Server)
+	}
+}
+
+func TestVerifyServer(t *testing.T) {
+	tests := []struct {
+		target string
+		server string
+		match  bool
+	}{
+		{target: "31011@haswell2", server: "31011@haswell2", match: true},
+		{target: "31011@HASWELL2", server: "31011@haswell2", match: true},
+		{target: "haswell2", server: "31011@haswell2", match: true},
+		{target: "31011@haswell2.osc.edu", server: "31011@haswell2", match: true},
+		{target: "31011@haswell2", server: "", match: false},
+		{target: "31010@haswell2", server: "31011@haswell2", match: false},
+		{target: "31011@license01", server: "31011@haswell2", match: false},
+		{target: "31011@haswell2.osc.edu", server: "31011@haswell2.example.com", match: false},
+	}
+	for _, test := range tests {
+		err := verifyServer(test.target, ServerHeader{Server: test.server})
+		if test.match && err != nil {
+			t.Errorf("Unexpected error for target %s server %s: %s", test.target, test.server, err)
+		}
+		if !test.match && err == nil {
+			t.Errorf("Expected mismatch for target %s server %s", test.target, test.server)
+		}
+	}
+	allow := true
+	collectorAllowMissingServer = &allow
+	defer func() { allow = false }()
+	if err := verifyServer("31011@haswell2", ServerHeader{}); err != nil {
+		t.Errorf("Unexpected error with --collector.allow-missing-server: %s", err)
+	}
+}
+
+func TestServerInfoMismatch(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	mockNow, _ := time.Parse("01/02/2006", "07/01/2020")
+	timeNow = func() time.Time { return mockNow }
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return featureStdout, nil
+	}
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return programStdout, nil
+	}
+	expected := `
+	# HELP lsdyna_exporter_collect_error Indicates if error has occurred during collection
+	# TYPE lsdyna_exporter_collect_error gauge
+	lsdyna_exporter_collect_error{collector="feature"} 1
+	lsdyna_exporter_collect_error{collector="program"} 1
+	# HELP lsdyna_server_info License server reported by lstc_qrun
+	# TYPE lsdyna_server_info gauge
+	lsdyna_server_info{server="31011@haswell2",target="31011@license01",version=""} 1
+	`
+	featureCollector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@license01", runner, log.NewNopLogger()), log.NewNopLogger())
+	programCollector := NewProgramExporter(NewSnapshot(context.Background(), "31011@license01", runner, log.NewNopLogger()), log.NewNopLogger())
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(featureCollector)
+	registry.MustRegister(programCollector)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"lsdyna_exporter_collect_error", "lsdyna_server_info", "lsdyna_feature_used", "lsdyna_feature_user_used"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	runner := &fakeRunner{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	// lstc_qrun falls back to a default server or does not report one
+	runner.features = func(ctx context.Context, target string) (string, error) {
+		return strings.Replace(featureStdout, "Using user specified server 31011@haswell2", "Using default server 31010@localhost", 1), nil
+	}
+	runner.programs = func(ctx context.Context, target string) (string, error) {
+		return strings.Replace(programStdout, "Using user specified server 31011@haswell2", "", 1), nil
+	}
+	expected := `
+	# HELP lsdyna_exporter_collect_error Indicates if error has occurred during collection
+	# TYPE lsdyna_exporter_collect_error gauge
+	lsdyna_exporter_collect_error{collector="feature"} 1
+	lsdyna_exporter_collect_error{collector="program"} 1
+	# HELP lsdyna_server_info License server reported by lstc_qrun
+	# TYPE lsdyna_server_info gauge
+	lsdyna_server_info{server="31010@localhost",target="31011@haswell2",version=""} 1
+	`
+	featureCollector := NewFeatureExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	programCollector := NewProgramExporter(NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger()), log.NewNopLogger())
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(featureCollector)
+	registry.MustRegister(programCollector)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"lsdyna_exporter_collect_error", "lsdyna_server_info", "lsdyna_feature_used", "lsdyna_feature_user_used"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	collectorConcurrent = kingpin.Flag("collector.concurrent",
+		"Run the lstc_qrun feature and programs reports of a scrape concurrently").Default("false").Bool()
+	collectorRetries = kingpin.Flag("collector.retries",
+		"Number of times a report that failed to connect or returned no output is retried within the collector timeout").Default("2").Int()
+	collectorRetryBackoff = kingpin.Flag("collector.retry-backoff",
+		"Delay before the first retry, doubled for each further retry").Default("500ms").Duration()
+	retryJitter    = rand.Float64
+	errEmptyOutput = errors.New("lstc_qrun returned no output")
+)
+
+// Snapshot is the lstc_qrun reports of a target for one scrape. Each report is
+// run and parsed once and shared by the collectors. Both reports share one
+// deadline, the larger of the feature and programs timeouts, and each report
+// is also limited by its own timeout. The deadline of the scrape's context,
+// such as the Prometheus scrape timeout, caps both.
+type Snapshot struct {
+	target      string
+	runner      Runner
+	logger      log.Logger
+	parent      context.Context
+	startOnce   sync.Once
+	ctx         context.Context
+	cancel      context.CancelFunc
+	runMutex    sync.Mutex
+	featureOnce sync.Once
+	feature     featureReport
+	programOnce sync.Once
+	program     programReport
+}
+
+type featureReport struct {
+	metrics  []FeatureMetric
+	groups   []GroupMetric
+	header   ServerHeader
+	attempts int
+	err      error
+}
+
+type programReport struct {
+	metrics  []ProgramMetric
+	attempts int
+	err      error
+}
+
+// NewSnapshot returns a Snapshot of target for the scrape of ctx, a nil runner
+// runs the lstc_qrun binary.
+func NewSnapshot(ctx context.Context, target string, runner Runner, logger log.Logger) *Snapshot {
+	return &Snapshot{
+		parent: ctx,
+		target: target,
+		runner: defaultRunner(runner),
+		logger: logger,
+	}
+}
+
+// Close releases the deadline of the snapshot.
+func (s *Snapshot) Close() {
+	s.start()
+	s.cancel()
+}
+
+func (s *Snapshot) start() {
+	s.startOnce.Do(func() {
+		timeout := *featureTimeout
+		if *programTimeout > timeout {
+			timeout = *programTimeout
+		}
+		s.ctx, s.cancel = context.WithTimeout(s.parent, timeout)
+	})
+}
+
+// run runs one report of the snapshot, reports are run one at a time unless
+// --collector.concurrent is set. Connection failures and empty output are
+// retried with exponential backoff while the retry fits in the timeout.
+// The number of attempts is returned with the output.
+func (s *Snapshot) run(timeout time.Duration, report func(ctx context.Context, target string) (string, error)) (string, int, error) {
+	s.start()
+	if !*collectorConcurrent {
+		s.runMutex.Lock()
+		defer s.runMutex.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	// The circuit breaker records one outcome for all attempts of the report
+	ctx, reportBreaker := withBreakerReport(ctx)
+	defer reportBreaker.finish()
+	backoff := *collectorRetryBackoff
+	for attempts := 1; ; attempts++ {
+		out, err := report(ctx, s.target)
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", attempts, ctx.Err()
+		}
+		if err == nil && strings.TrimSpace(out) == "" {
+			err = errEmptyOutput
+		}
+		if err == nil || attempts > *collectorRetries || !retryable(err) {
+			return out, attempts, err
+		}
+		// Jitter spreads the retries of targets that failed together
+		delay := time.Duration((0.5 + retryJitter()) * float64(backoff))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return out, attempts, err
+		}
+		level.Debug(s.logger).Log("msg", "Retrying lstc_qrun", "target", s.target, "attempt", attempts, "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return out, attempts, err
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns true for failures that may succeed when run again.
+func retryable(err error) bool {
+	return errors.Is(err, errEmptyOutput) || errorReason(err) == reasonConnectionRefused
+}
+
+func (s *Snapshot) features() ([]FeatureMetric, []GroupMetric, ServerHeader, error) {
+	s.featureOnce.Do(func() {
+		s.feature = s.runFeatures()
+	})
+	return s.feature.metrics, s.feature.groups, s.feature.header, s.feature.err
+}
+
+func (s *Snapshot) runFeatures() featureReport {
+	var report featureReport
+	out, attempts, err := s.run(*featureTimeout, s.runner.Features)
+	report.attempts = attempts
+	if err != nil {
+		report.err = err
+		return report
+	}
+	report.header = lstc_qrun_header_parse(out)
+	if err = verifyServer(s.target, report.header); err != nil {
+		report.err = err
+		return report
+	}
+	report.metrics, report.groups, err = lstc_qrun_r_parse(out)
+	if err != nil {
+		return featureReport{header: report.header, attempts: attempts, err: &parseError{err: err}}
+	}
+	return report
+}
+
+func (s *Snapshot) programs() ([]ProgramMetric, error) {
+	s.programOnce.Do(func() {
+		s.program = s.runPrograms()
+	})
+	return s.program.metrics, s.program.err
+}
+
+func (s *Snapshot) runPrograms() programReport {
+	out, attempts, err := s.run(*programTimeout, s.runner.Programs)
+	if err != nil {
+		return programReport{attempts: attempts, err: err}
+	}
+	if err = verifyServer(s.target, lstc_qrun_header_parse(out)); err != nil {
+		return programReport{attempts: attempts, err: err}
+	}
+	metrics, err := lstc_qrun_p_parse(out, s.logger)
+	if err != nil {
+		return programReport{attempts: attempts, err: &parseError{err: err}}
+	}
+	return programReport{metrics: metrics, attempts: attempts}
+}
@@ -0,0 +1,295 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotShared(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	var featureCalls, programCalls int32
+	runner := &fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			atomic.AddInt32(&featureCalls, 1)
+			return featureStdout, nil
+		},
+		programs: func(ctx context.Context, target string) (string, error) {
+			atomic.AddInt32(&programCalls, 1)
+			return programStdout, nil
+		},
+	}
+	expected := `
+	# HELP lsdyna_feature_used_difference Number of used licenses of a feature or license group minus the licenses used by its running programs
+	# TYPE lsdyna_feature_used_difference gauge
+	lsdyna_feature_used_difference{name="LS-DYNA+MPPDYNA"} -38
+	`
+	snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+	defer snapshot.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewFeatureExporter(snapshot, log.NewNopLogger()))
+	registry.MustRegister(NewProgramExporter(snapshot, log.NewNopLogger()))
+	registry.MustRegister(NewUsageExporter(snapshot, log.NewNopLogger()))
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"lsdyna_feature_used_difference"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if featureCalls != 1 || programCalls != 1 {
+		t.Errorf("Unexpected lstc_qrun calls, features %d programs %d", featureCalls, programCalls)
+	}
+}
+
+func TestUsedDifferenceGroups(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	featureOut, err := os.ReadFile("testdata/features-groups.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	programOut, err := os.ReadFile("testdata/programs-queued.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	features, groups, err := lstc_qrun_r_parse(string(featureOut))
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs, err := lstc_qrun_p_parse(string(programOut), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 38 licenses of running MPPDYNA programs draw from the group's 40
+	expected := map[string]float64{
+		"LS-DYNA+MPPDYNA+MPPDYNA_971": 2,
+		"LS-OPT":                      2,
+		"LS-PREPOST":                  1,
+	}
+	difference := usedDifference(features, groups, programs)
+	if len(difference) != len(expected) {
+		t.Errorf("Unexpected differences %v", difference)
+	}
+	for name, value := range expected {
+		if difference[name] != value {
+			t.Errorf("Unexpected difference of %s, got %v expected %v", name, difference[name], value)
+		}
+	}
+}
+
+func TestSnapshotError(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	runner := &fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			return featureStdout, nil
+		},
+		programs: func(ctx context.Context, target string) (string, error) {
+			return "", context.DeadlineExceeded
+		},
+	}
+	snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+	defer snapshot.Close()
+	if val, err := testutil.GatherAndCount(setupGatherer(NewUsageExporter(snapshot, log.NewNopLogger()))); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if val != 0 {
+		t.Errorf("Unexpected collection count %d, expected 0", val)
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		concurrent bool
+		running    int
+	}{
+		{concurrent: false, running: 1},
+		{concurrent: true, running: 2},
+	}
+	for _, test := range tests {
+		*collectorConcurrent = test.concurrent
+		var mutex sync.Mutex
+		running := 0
+		maxRunning := 0
+		report := func(out string) func(ctx context.Context, target string) (string, error) {
+			return func(ctx context.Context, target string) (string, error) {
+				mutex.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mutex.Unlock()
+				// Give the other report a chance to start
+				select {
+				case <-time.After(200 * time.Millisecond):
+				case <-ctx.Done():
+				}
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+				return out, nil
+			}
+		}
+		runner := &fakeRunner{features: report(featureStdout), programs: report(programStdout)}
+		snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewFeatureExporter(snapshot, log.NewNopLogger()))
+		registry.MustRegister(NewProgramExporter(snapshot, log.NewNopLogger()))
+		if _, err := registry.Gather(); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		snapshot.Close()
+		if maxRunning != test.running {
+			t.Errorf("Unexpected running reports with concurrent %v, got %d expected %d", test.concurrent, maxRunning, test.running)
+		}
+	}
+	*collectorConcurrent = false
+}
+
+func TestSnapshotRetry(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--collector.retry-backoff=1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	featureCalls := 0
+	programCalls := 0
+	runner := &fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			featureCalls++
+			if featureCalls == 1 {
+				return "", fmt.Errorf("Unable to connect to 31011@haswell2: Connection refused")
+			}
+			return featureStdout, nil
+		},
+		programs: func(ctx context.Context, target string) (string, error) {
+			programCalls++
+			return "", nil
+		},
+	}
+	expected := `
+	# HELP lsdyna_exporter_collect_attempts Number of lstc_qrun attempts made during collection
+	# TYPE lsdyna_exporter_collect_attempts gauge
+	lsdyna_exporter_collect_attempts{collector="feature"} 2
+	lsdyna_exporter_collect_attempts{collector="program"} 3
+	# HELP lsdyna_exporter_collect_error Indicates if error has occurred during collection
+	# TYPE lsdyna_exporter_collect_error gauge
+	lsdyna_exporter_collect_error{collector="feature"} 0
+	lsdyna_exporter_collect_error{collector="program"} 1
+	`
+	snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+	defer snapshot.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewFeatureExporter(snapshot, log.NewNopLogger()))
+	registry.MustRegister(NewProgramExporter(snapshot, log.NewNopLogger()))
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"lsdyna_exporter_collect_attempts", "lsdyna_exporter_collect_error"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if _, err := snapshot.programs(); err != errEmptyOutput {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestSnapshotRetryDeadline(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--collector.feature.timeout=1",
+		"--collector.retry-backoff=5s"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	calls := 0
+	runner := &fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			calls++
+			return "", fmt.Errorf("connect: Connection refused")
+		},
+	}
+	snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+	defer snapshot.Close()
+	start := time.Now()
+	_, _, _, err := snapshot.features()
+	if reason := errorReason(err); reason != "connection_refused" {
+		t.Errorf("Unexpected reason %s", reason)
+	}
+	if calls != 1 {
+		t.Errorf("Expected no retry beyond the timeout, got %d calls", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Retry waited past the timeout, took %s", elapsed)
+	}
+}
+
+func TestSnapshotParentContext(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne", "--collector.programs.timeout=1500ms"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	runner := &fakeRunner{
+		features: func(ctx context.Context, target string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+		programs: func(ctx context.Context, target string) (string, error) {
+			deadline, _ := ctx.Deadline()
+			if timeout := time.Until(deadline); timeout > 1500*time.Millisecond || timeout < time.Second {
+				t.Errorf("Unexpected programs timeout %s", timeout)
+			}
+			return programStdout, nil
+		},
+	}
+	snapshot := NewSnapshot(context.Background(), "31011@haswell2", runner, log.NewNopLogger())
+	if _, err := snapshot.programs(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	snapshot.Close()
+	// The client disconnecting cancels the running report
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshot = NewSnapshot(ctx, "31011@haswell2", runner, log.NewNopLogger())
+	defer snapshot.Close()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, _, err := snapshot.features(); err != context.Canceled {
+		t.Errorf("Expected canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Report was not canceled, took %s", elapsed)
+	}
+}
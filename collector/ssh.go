@@ -0,0 +1,214 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHRunner runs lstc_qrun on a remote host over SSH. The connection is kept
+// open and reused by later scrapes, and is dialed again when it is lost.
+type SSHRunner struct {
+	config       *SSHConfig
+	command      lstcQrunCommand
+	clientConfig *ssh.ClientConfig
+	mutex        sync.Mutex
+	client       *ssh.Client
+}
+
+// NewSSHRunner returns a Runner for the SSH configuration of target, the key
+// and known hosts are read immediately. lstc_qrun is found in the remote
+// user's PATH unless the target sets its path.
+func NewSSHRunner(target *TargetConfig) (*SSHRunner, error) {
+	config := target.SSH
+	key, err := os.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", config.KeyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(config.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHRunner{
+		config:  config,
+		command: target.command("lstc_qrun"),
+		clientConfig: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+func (r *SSHRunner) Features(ctx context.Context, target string) (string, error) {
+	out, stderr, err := r.run(ctx, "feature", featuresArgs(target)...)
+	return featuresResult(out, stderr, err)
+}
+
+func (r *SSHRunner) Programs(ctx context.Context, target string) (string, error) {
+	out, stderr, err := r.run(ctx, "program", programsArgs(target)...)
+	return programsResult(out, stderr, err)
+}
+
+// Close closes the connection to the remote host.
+func (r *SSHRunner) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+// run executes lstc_qrun on the remote host. When ctx is done the remote
+// command is sent SIGKILL and its session closed without waiting for it.
+func (r *SSHRunner) run(ctx context.Context, collector string, args ...string) (string, string, error) {
+	session, err := r.newSession(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+	stdout := &limitedBuffer{limit: int(*lstcQrunMaxOutput)}
+	stderr := &limitedBuffer{limit: int(*lstcQrunMaxOutput)}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(r.remoteCommand(args))
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		lstcQrunKilled.WithLabelValues(collector).Inc()
+		_ = session.Signal(ssh.SIGKILL)
+		return "", "", ctx.Err()
+	}
+	if stdout.exceeded || stderr.exceeded {
+		return "", "", &ExecError{Message: fmt.Sprintf("lstc_qrun output exceeded %d bytes", stdout.limit)}
+	}
+	return stdout.String(), stderr.String(), err
+}
+
+// remoteCommand is the remote command line, quoted for the remote user's
+// shell. The environment is set with env since SSH servers usually refuse
+// environment variables sent by the client.
+func (r *SSHRunner) remoteCommand(args []string) string {
+	var quoted []string
+	if len(r.command.env) > 0 {
+		quoted = append(quoted, "env")
+		for _, env := range r.command.env {
+			quoted = append(quoted, shellQuote(env))
+		}
+	}
+	quoted = append(quoted, shellQuote(r.command.path))
+	for _, arg := range r.command.arguments(args...) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	command := strings.Join(quoted, " ")
+	if r.command.dir != "" {
+		command = "cd " + shellQuote(r.command.dir) + " && " + command
+	}
+	return command
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// newSession opens a session on the existing connection. A connection the
+// remote host has closed is only noticed when opening the session fails,
+// so that is retried once on a new connection.
+func (r *SSHRunner) newSession(ctx context.Context) (*ssh.Session, error) {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	r.disconnect(client)
+	if client, err = r.connect(ctx); err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// connect returns the open connection or dials a new one within the deadline of ctx.
+func (r *SSHRunner) connect(ctx context.Context) (*ssh.Client, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client != nil {
+		return r.client, nil
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake has no context, so close the connection if ctx is done first
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, r.config.Host, r.clientConfig)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	r.client = client
+	go func() {
+		_ = client.Wait()
+		r.disconnect(client)
+	}()
+	return client, nil
+}
+
+// disconnect closes client and forgets it if it is still the open connection.
+func (r *SSHRunner) disconnect(client *ssh.Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client == client {
+		r.client = nil
+	}
+	_ = client.Close()
+}
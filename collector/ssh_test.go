@@ -0,0 +1,345 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshServer is an in-process SSH server that answers every exec request with
+// the configured output and exit status.
+type sshServer struct {
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	hostKey     ssh.Signer
+	mutex       sync.Mutex
+	stdout      string
+	stderr      string
+	exitStatus  uint32
+	sleep       time.Duration
+	commands    []string
+	connections []net.Conn
+}
+
+func newSSHServer(t *testing.T, clientKey ssh.PublicKey) *sshServer {
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{hostKey: hostKey}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "lsdyna" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.listener.Close()
+		s.closeConnections()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections = append(s.connections, conn)
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *sshServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+func (s *sshServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			return
+		}
+		_ = req.Reply(true, nil)
+		s.mutex.Lock()
+		s.commands = append(s.commands, payload.Command)
+		stdout, stderr, exitStatus, sleep := s.stdout, s.stderr, s.exitStatus, s.sleep
+		s.mutex.Unlock()
+		_, _ = channel.Write([]byte(stdout))
+		_, _ = channel.Stderr().Write([]byte(stderr))
+		time.Sleep(sleep)
+		status := struct{ Status uint32 }{exitStatus}
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+func (s *sshServer) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.connections {
+		conn.Close()
+	}
+}
+
+func (s *sshServer) connectionCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.connections)
+}
+
+// newTestSSHRunner returns a runner for server with the host key trusted when trusted is set.
+func newTestSSHRunner(t *testing.T, trusted bool) (*SSHRunner, *sshServer) {
+	return newTestSSHTargetRunner(t, &TargetConfig{}, trusted)
+}
+
+func newTestSSHTargetRunner(t *testing.T, target *TargetConfig, trusted bool) (*SSHRunner, *sshServer) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.lstc_qrun=/dne"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSSHServer(t, clientKey)
+	address := server.listener.Addr().String()
+	hostKey := server.hostKey.PublicKey()
+	if !trusted {
+		_, otherPrivate, _ := ed25519.GenerateKey(rand.Reader)
+		other, _ := ssh.NewSignerFromKey(otherPrivate)
+		hostKey = other.PublicKey()
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey) + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target.SSH = &SSHConfig{
+		Host:           address,
+		User:           "lsdyna",
+		KeyFile:        keyFile,
+		KnownHostsFile: knownHostsFile,
+	}
+	if err := target.SSH.validate(); err != nil {
+		t.Fatal(err)
+	}
+	runner, err := NewSSHRunner(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		runner.Close()
+	})
+	return runner, server
+}
+
+func TestSSHRunnerFeatures(t *testing.T) {
+	runner, server := newTestSSHRunner(t, true)
+	server.stdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		out, err := runner.Features(ctx, "31011@haswell2")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if out != "foo" {
+			t.Errorf("Unexpected out: %s", out)
+		}
+	}
+	if count := server.connectionCount(); count != 1 {
+		t.Errorf("Expected connection to be reused, got %d connections", count)
+	}
+	expected := `'lstc_qrun' '-r' '-s' '31011@haswell2'`
+	if server.commands[0] != expected {
+		t.Errorf("Unexpected command %s", server.commands[0])
+	}
+}
+
+func TestSSHRunnerTargetCommand(t *testing.T) {
+	target := &TargetConfig{
+		LstcQrun:   "/opt/lstc/R11/lstc_qrun",
+		Args:       []string{"-R"},
+		Env:        map[string]string{"LSTC_LICENSE": "network"},
+		WorkingDir: "/opt/lstc/it's here",
+	}
+	runner, server := newTestSSHTargetRunner(t, target, true)
+	server.stdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := runner.Programs(ctx, "31011@haswell2"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := `cd '/opt/lstc/it'\''s here' && env 'LSTC_LICENSE=network' '/opt/lstc/R11/lstc_qrun' '-R' '-s' '31011@haswell2' '-p'`
+	if server.commands[0] != expected {
+		t.Errorf("Unexpected command %s", server.commands[0])
+	}
+}
+
+func TestSSHRunnerProgramsError(t *testing.T) {
+	runner, server := newTestSSHRunner(t, true)
+	server.stderr = "Unable to connect to 31011@haswell2: Connection refused"
+	server.exitStatus = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runner.Programs(ctx, "31011@haswell2")
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if execErr.ExitCode != 1 {
+		t.Errorf("Unexpected exit code %d", execErr.ExitCode)
+	}
+	if reason := errorReason(err); reason != "connection_refused" {
+		t.Errorf("Unexpected reason %s", reason)
+	}
+}
+
+func TestSSHRunnerReconnect(t *testing.T) {
+	runner, server := newTestSSHRunner(t, true)
+	server.stdout = "foo"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := runner.Features(ctx, "host"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	server.closeConnections()
+	out, err := runner.Features(ctx, "host")
+	if err != nil {
+		t.Fatalf("Unexpected error after connection was closed: %s", err.Error())
+	}
+	if out != "foo" {
+		t.Errorf("Unexpected out: %s", out)
+	}
+	if count := server.connectionCount(); count != 2 {
+		t.Errorf("Expected a new connection, got %d connections", count)
+	}
+}
+
+func TestSSHRunnerTimeout(t *testing.T) {
+	runner, server := newTestSSHRunner(t, true)
+	server.sleep = 30 * time.Second
+	killed := testutil.ToFloat64(lstcQrunKilled.WithLabelValues("feature"))
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runner.Features(ctx, "host")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lstc_qrun did not stop after timeout, took %s", elapsed)
+	}
+	if val := testutil.ToFloat64(lstcQrunKilled.WithLabelValues("feature")) - killed; val != 1 {
+		t.Errorf("Unexpected killed count %v", val)
+	}
+}
+
+func TestSSHRunnerUnknownHostKey(t *testing.T) {
+	runner, _ := newTestSSHRunner(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runner.Features(ctx, "host")
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("Expected host key error, got %v", err)
+	}
+}
+
+func TestTargetRunner(t *testing.T) {
+	sshRunner, server := newTestSSHRunner(t, true)
+	server.stdout = "remote"
+	runner := &TargetRunner{
+		local: &fakeRunner{
+			features: func(ctx context.Context, target string) (string, error) {
+				return "local", nil
+			},
+		},
+		targets: map[string]Runner{"31011@remote": sshRunner},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if out, _ := runner.Features(ctx, "31011@remote"); out != "remote" {
+		t.Errorf("Unexpected out of ssh target: %s", out)
+	}
+	if out, _ := runner.Features(ctx, "31011@local"); out != "local" {
+		t.Errorf("Unexpected out of local target: %s", out)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	exporterStateDir = kingpin.Flag("exporter.state-dir",
+		"Directory where cached metrics are saved and loaded from at startup, empty to keep them only in memory").Default("").String()
+)
+
+// stateFile is the saved cache entry of a target.
+type stateFile[T any] struct {
+	Target  string    `json:"target"`
+	Written time.Time `json:"written"`
+	Value   T         `json:"value"`
+}
+
+// LoadState loads the cached metrics saved in --exporter.state-dir,
+// files that cannot be read are logged and skipped.
+func LoadState(logger log.Logger) error {
+	if *exporterStateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*exporterStateDir, 0700); err != nil {
+		return err
+	}
+	if err := featureCache.load(*exporterStateDir, logger); err != nil {
+		return err
+	}
+	return programCache.load(*exporterStateDir, logger)
+}
+
+func (c *metricCache[T]) statePath(dir string, target string) string {
+	return filepath.Join(dir, c.collector+"-"+url.PathEscape(target)+".json")
+}
+
+// save writes the entry of target to the state directory. The file is written
+// to a temporary file that is renamed into place so it is never left partial.
+func (c *metricCache[T]) save(target string, entry *cacheEntry[T]) error {
+	dir := *exporterStateDir
+	data, err := json.Marshal(stateFile[T]{Target: target, Written: entry.written, Value: entry.value})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+c.collector+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.statePath(dir, target))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to save cached %s metrics of %s: %w", c.collector, target, err)
+	}
+	return nil
+}
+
+// removeState removes the saved entry of target.
+func (c *metricCache[T]) removeState(target string) {
+	if *exporterStateDir == "" {
+		return
+	}
+	// A file left behind is removed when it is loaded after --exporter.cache-max-age
+	_ = os.Remove(c.statePath(*exporterStateDir, target))
+}
+
+// load reads the entries saved in dir, files of entries older than
+// --exporter.cache-max-age are removed.
+func (c *metricCache[T]) load(dir string, logger log.Logger) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, c.collector+"-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Unable to read cache state file", "path", path, "err", err)
+			continue
+		}
+		var state stateFile[T]
+		if err := json.Unmarshal(data, &state); err != nil {
+			level.Warn(logger).Log("msg", "Ignoring corrupt cache state file", "path", path, "err", err)
+			continue
+		}
+		if state.Target == "" || state.Written.IsZero() {
+			level.Warn(logger).Log("msg", "Ignoring incomplete cache state file", "path", path)
+			continue
+		}
+		if *exporterCacheMaxAge > 0 && now.Sub(state.Written) > *exporterCacheMaxAge {
+			level.Debug(logger).Log("msg", "Removing expired cache state file", "path", path, "written", state.Written)
+			if err := os.Remove(path); err != nil {
+				level.Warn(logger).Log("msg", "Unable to remove expired cache state file", "path", path, "err", err)
+			}
+			continue
+		}
+		c.mutex.Lock()
+		if entry, ok := c.entries[state.Target]; !ok || entry.written.Before(state.Written) {
+			c.entries[state.Target] = &cacheEntry[T]{value: state.Value, written: state.Written, scraped: now}
+		}
+		c.mutex.Unlock()
+		level.Debug(logger).Log("msg", "Loaded cached metrics", "collector", c.collector, "target", state.Target)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestStateSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	now := setupCache(t, "--exporter.state-dir="+dir)
+	value := featureCacheValue{
+		Metrics: []FeatureMetric{{Name: "MPPDYNA", Used: 2, Free: 498, Total: 500}},
+		Groups:  []GroupMetric{{Name: "MPPDYNA", Features: []string{"MPPDYNA"}, Total: 500}},
+	}
+	if err := featureCache.write("31011@license01", value); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	started := now.Add(-time.Hour).Round(time.Second)
+	if err := programCache.write("31011@license01", []ProgramMetric{{User: "hna", PID: "1234", Started: started}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	featureCache.reset()
+	programCache.reset()
+	*now = now.Add(time.Minute)
+	if err := LoadState(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	features, ok := featureCache.read("31011@license01")
+	if !ok {
+		t.Fatalf("Expected feature metrics to be loaded")
+	}
+	if features.Metrics[0].Name != "MPPDYNA" || features.Metrics[0].Free != 498 || features.Groups[0].Features[0] != "MPPDYNA" {
+		t.Errorf("Unexpected feature metrics %v", features)
+	}
+	programs, ok := programCache.read("31011@license01")
+	if !ok {
+		t.Fatalf("Expected program metrics to be loaded")
+	}
+	if programs[0].User != "hna" || !programs[0].Started.Equal(started) {
+		t.Errorf("Unexpected program metrics %v", programs)
+	}
+	if age := featureCache.ages()["31011@license01"]; age != 60 {
+		t.Errorf("Expected age to be kept across restarts, got %v", age)
+	}
+}
+
+func TestStateLoadMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	now := setupCache(t, "--exporter.state-dir="+dir, "--exporter.cache-max-age=1h")
+	_ = programCache.write("31011@license01", []ProgramMetric{{User: "hna"}})
+	*now = now.Add(30 * time.Minute)
+	_ = programCache.write("31011@license02", []ProgramMetric{{User: "hna"}})
+	programCache.reset()
+	*now = now.Add(45 * time.Minute)
+	if err := LoadState(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	ages := programCache.ages()
+	if _, ok := ages["31011@license01"]; ok {
+		t.Errorf("Expected metrics older than max age not to be loaded")
+	}
+	if _, err := os.Stat(programCache.statePath(dir, "31011@license01")); !os.IsNotExist(err) {
+		t.Errorf("Expected file older than max age to be removed, got %v", err)
+	}
+	if _, ok := ages["31011@license02"]; !ok {
+		t.Errorf("Expected metrics within max age to be loaded")
+	}
+}
+
+func TestStateLoadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	setupCache(t, "--exporter.state-dir="+dir)
+	_ = featureCache.write("31011@license01", featureCacheValue{Metrics: []FeatureMetric{{Name: "MPPDYNA"}}})
+	data, err := os.ReadFile(featureCache.statePath(dir, "31011@license01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"feature-31011@partial.json":   data[:len(data)/2],
+		"feature-31011@empty.json":     {},
+		"feature-31011@corrupt.json":   []byte("not json"),
+		"feature-31011@missing.json":   []byte(`{"value":{}}`),
+		".feature-1234.tmp":            data,
+		"program-31011@license01.json": []byte(`{"target":"31011@license01","written":"2020-01-01T00:00:00Z",`),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	featureCache.reset()
+	if err := LoadState(log.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	ages := featureCache.ages()
+	if len(ages) != 1 {
+		t.Errorf("Expected only the valid file to be loaded, got %v", ages)
+	}
+	if _, ok := ages["31011@license01"]; !ok {
+		t.Errorf("Expected valid file to be loaded")
+	}
+	if ages := programCache.ages(); len(ages) != 0 {
+		t.Errorf("Expected partial program file not to be loaded, got %v", ages)
+	}
+}
+
+func TestStateSaveError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dne")
+	setupCache(t, "--exporter.state-dir="+dir)
+	if err := programCache.write("31011@license01", nil); err == nil {
+		t.Errorf("Expected error saving to missing state directory")
+	}
+	if _, ok := programCache.read("31011@license01"); !ok {
+		t.Errorf("Expected metrics to be cached in memory when saving fails")
+	}
+}
+
+func TestStateExpire(t *testing.T) {
+	dir := t.TempDir()
+	now := setupCache(t, "--exporter.state-dir="+dir, "--exporter.cache-expire=1h")
+	_ = featureCache.write("31011@license01", featureCacheValue{})
+	*now = now.Add(2 * time.Hour)
+	_ = featureCache.write("31011@license02", featureCacheValue{})
+	if _, err := os.Stat(featureCache.statePath(dir, "31011@license01")); !os.IsNotExist(err) {
+		t.Errorf("Expected file of expired target to be removed, got %v", err)
+	}
+	if _, err := os.Stat(featureCache.statePath(dir, "31011@license02")); err != nil {
+		t.Errorf("Expected file of cached target, got %v", err)
+	}
+}
+
+func TestStateSaveConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	setupCache(t, "--exporter.state-dir="+dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("31011@license%02d", i%4)
+			if err := programCache.write(target, []ProgramMetric{{PID: fmt.Sprint(i)}}); err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	// The saved file of each target is the report cached in memory
+	for i := 0; i < 4; i++ {
+		target := fmt.Sprintf("31011@license%02d", i)
+		cached, _ := programCache.read(target)
+		data, err := os.ReadFile(programCache.statePath(dir, target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state stateFile[[]ProgramMetric]
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Value[0].PID != cached[0].PID {
+			t.Errorf("Saved PID %s of %s is not the cached PID %s", state.Value[0].PID, target, cached[0].PID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UsageCollector cross-checks the feature and programs reports of a snapshot.
+type UsageCollector struct {
+	UsedDifference *prometheus.Desc
+	snapshot       *Snapshot
+	logger         log.Logger
+}
+
+// NewUsageExporter returns a collector comparing the used licenses of each
+// feature with the licenses used by its running programs.
+func NewUsageExporter(snapshot *Snapshot, logger log.Logger) Collector {
+	return &UsageCollector{
+		UsedDifference: prometheus.NewDesc(prometheus.BuildFQName(namespace, "feature", "used_difference"),
+			"Number of used licenses of a feature or license group minus the licenses used by its running programs", []string{"name"}, nil),
+		snapshot: snapshot,
+		logger:   logger,
+	}
+}
+
+func (c *UsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.UsedDifference
+}
+
+// Collect only exports the difference when both reports were collected,
+// failures are reported by the feature and program collectors.
+func (c *UsageCollector) Collect(ch chan<- prometheus.Metric) {
+	level.Debug(c.logger).Log("msg", "Collecting usage metrics")
+	features, groups, _, err := c.snapshot.features()
+	if err != nil {
+		return
+	}
+	programs, err := c.snapshot.programs()
+	if err != nil {
+		return
+	}
+	for name, difference := range usedDifference(features, groups, programs) {
+		if difference != 0 {
+			level.Debug(c.logger).Log("msg", "Used licenses do not match running programs", "feature", name, "difference", difference)
+		}
+		ch <- prometheus.MustNewConstMetric(c.UsedDifference, prometheus.GaugeValue, difference, name)
+	}
+}
+
+// usedDifference returns the used licenses of each feature minus the
+// licenses used by running programs of the feature. Every feature of a
+// LICENSE GROUP reports the group's usage as its own, so grouped features are
+// compared once as the group, named like the group metrics.
+func usedDifference(features []FeatureMetric, groups []GroupMetric, programs []ProgramMetric) map[string]float64 {
+	difference := make(map[string]float64)
+	memberOf := make(map[string]string)
+	for _, g := range groups {
+		difference[g.Name] += g.Used
+		for _, feature := range g.Features {
+			memberOf[feature] = g.Name
+		}
+	}
+	for _, f := range features {
+		if _, ok := memberOf[f.Name]; ok {
+			continue
+		}
+		difference[f.Name] += f.Used
+	}
+	for _, p := range programs {
+		if p.Queued {
+			continue
+		}
+		name := p.Program
+		if group, ok := memberOf[name]; ok {
+			name = group
+		}
+		difference[name] -= p.Used
+	}
+	return difference
+}
@@ -7,6 +7,9 @@ require (
 	github.com/go-kit/log v0.2.1
 	github.com/prometheus/client_golang v1.15.1
 	github.com/prometheus/common v0.43.0
+	golang.org/x/crypto v0.8.0
+	golang.org/x/sys v0.8.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -16,10 +19,10 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/prometheus/client_model v0.4.0 // indirect
 	github.com/prometheus/procfs v0.9.0 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
 )
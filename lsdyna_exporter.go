@@ -14,8 +14,13 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
+	// Embed timezone data for --collector.feature.timezone on hosts without zoneinfo
+	_ "time/tzdata"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
@@ -30,9 +35,15 @@ import (
 
 var (
 	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9309").String()
+	configFile    = kingpin.Flag("config.file", "Path to the per-target configuration file").Default("").String()
+	timeoutOffset = kingpin.Flag("web.timeout-offset",
+		"Offset to subtract from the Prometheus scrape timeout to leave time to return the response").Default("500ms").Duration()
 )
 
-func metricsHandler(logger log.Logger) http.HandlerFunc {
+// metricsHandler collects the target of each request using runner,
+// a nil runner runs the lstc_qrun binary. Collection stops when the client
+// disconnects or the Prometheus scrape timeout is reached.
+func metricsHandler(runner collector.Runner, logger log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		registry := prometheus.NewRegistry()
 
@@ -42,10 +53,22 @@ func metricsHandler(logger log.Logger) http.HandlerFunc {
 			return
 		}
 
-		featureExporter := collector.NewFeatureExporter(target, logger)
-		programExporter := collector.NewProgramExporter(target, logger)
+		ctx := r.Context()
+		if timeout, ok := scrapeTimeout(r, logger); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		// Collectors of a request share one run of each lstc_qrun report
+		snapshot := collector.NewSnapshot(ctx, target, runner, logger)
+		defer snapshot.Close()
+		featureExporter := collector.NewFeatureExporter(snapshot, logger)
+		programExporter := collector.NewProgramExporter(snapshot, logger)
+		usageExporter := collector.NewUsageExporter(snapshot, logger)
 		registry.MustRegister(featureExporter)
 		registry.MustRegister(programExporter)
+		registry.MustRegister(usageExporter)
 
 		gatherers := prometheus.Gatherers{registry}
 
@@ -55,7 +78,27 @@ func metricsHandler(logger log.Logger) http.HandlerFunc {
 	}
 }
 
+// scrapeTimeout returns the scrape timeout Prometheus sent minus --web.timeout-offset.
+// The full scrape timeout is used when the offset is larger.
+func scrapeTimeout(r *http.Request, logger log.Logger) (time.Duration, bool) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		level.Warn(logger).Log("msg", "Invalid scrape timeout header", "value", header)
+		return 0, false
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > *timeoutOffset {
+		timeout -= *timeoutOffset
+	}
+	return timeout, true
+}
+
 func main() {
+	collector.LimitsHelper()
 	metricsEndpoint := "/lsdyna"
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
@@ -66,6 +109,21 @@ func main() {
 	logger := promlog.New(promlogConfig)
 	level.Info(logger).Log("msg", "Starting lsdyna_exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+	config, err := collector.LoadConfig(*configFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading configuration", "err", err)
+		os.Exit(1)
+	}
+	targetRunner, err := collector.NewTargetRunner(config)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error configuring targets", "err", err)
+		os.Exit(1)
+	}
+	if err := collector.LoadState(logger); err != nil {
+		level.Error(logger).Log("msg", "Error loading cached metrics", "err", err)
+		os.Exit(1)
+	}
+	runner := collector.NewCoalescingRunner(collector.NewLimitedRunner(collector.NewBreakerRunner(targetRunner)))
 	level.Info(logger).Log("msg", "Starting Server", "address", *listenAddress)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -79,9 +137,9 @@ func main() {
              </body>
              </html>`))
 	})
-	http.Handle(metricsEndpoint, metricsHandler(logger))
+	http.Handle(metricsEndpoint, metricsHandler(runner, logger))
 	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(*listenAddress, nil)
+	err = http.ListenAndServe(*listenAddress, nil)
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
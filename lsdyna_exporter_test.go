@@ -18,13 +18,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
-	"github.com/treydock/lsdyna_exporter/collector"
 )
 
 const (
@@ -61,7 +62,7 @@ No programs queued
 
 func TestMain(m *testing.M) {
 	go func() {
-		http.Handle("/metrics", metricsHandler(log.NewNopLogger()))
+		http.Handle("/metrics", metricsHandler(&testRunner{}, log.NewNopLogger()))
 		err := http.ListenAndServe(address, nil)
 		if err != nil {
 			os.Exit(1)
@@ -74,13 +75,17 @@ func TestMain(m *testing.M) {
 	os.Exit(exitVal)
 }
 
+type testRunner struct{}
+
+func (r *testRunner) Features(ctx context.Context, target string) (string, error) {
+	return featureStdout, nil
+}
+
+func (r *testRunner) Programs(ctx context.Context, target string) (string, error) {
+	return programStdout, nil
+}
+
 func TestMetricsHandler(t *testing.T) {
-	collector.Lstc_qrun_rExec = func(target string, ctx context.Context) (string, error) {
-		return featureStdout, nil
-	}
-	collector.Lstc_qrun_pExec = func(target string, ctx context.Context) (string, error) {
-		return programStdout, nil
-	}
 	body, err := queryExporter()
 	if err != nil {
 		t.Fatalf("Unexpected error GET /metrics: %s", err.Error())
@@ -90,8 +95,50 @@ func TestMetricsHandler(t *testing.T) {
 	}
 }
 
+type deadlineRunner struct {
+	deadlines chan time.Duration
+}
+
+func (r *deadlineRunner) Features(ctx context.Context, target string) (string, error) {
+	deadline, _ := ctx.Deadline()
+	r.deadlines <- time.Until(deadline)
+	return featureStdout, nil
+}
+
+func (r *deadlineRunner) Programs(ctx context.Context, target string) (string, error) {
+	return programStdout, nil
+}
+
+func TestMetricsHandlerScrapeTimeout(t *testing.T) {
+	args := []string{"--path.lstc_qrun=/dne", "--web.timeout-offset=500ms"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header string
+		max    time.Duration
+		min    time.Duration
+	}{
+		{header: "2", max: 1500 * time.Millisecond, min: time.Second},
+		{header: "0.2", max: 200 * time.Millisecond, min: 0},
+		{header: "", max: 10 * time.Second, min: 9 * time.Second},
+		{header: "invalid", max: 10 * time.Second, min: 9 * time.Second},
+	}
+	for _, test := range tests {
+		runner := &deadlineRunner{deadlines: make(chan time.Duration, 1)}
+		req := httptest.NewRequest("GET", "/lsdyna?target=31011@haswell2", nil)
+		if test.header != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.header)
+		}
+		metricsHandler(runner, log.NewNopLogger()).ServeHTTP(httptest.NewRecorder(), req)
+		if timeout := <-runner.deadlines; timeout > test.max || timeout < test.min {
+			t.Errorf("Unexpected timeout %s for scrape timeout %q", timeout, test.header)
+		}
+	}
+}
+
 func queryExporter() (string, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/metrics?target=localhost", address))
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics?target=31011@haswell2", address))
 	if err != nil {
 		return "", err
 	}